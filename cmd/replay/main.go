@@ -0,0 +1,192 @@
+// Copyright (c) 2022 Network Plumbing Working Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This replays recorded admission reviews, or net-attach-def and pod manifests,
+// through the validation of the admission controller without a cluster.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/k8snetworkplumbingwg/net-attach-def-admission-controller/pkg/webhook"
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+)
+
+const (
+	exitAllowed = 0
+	exitDenied  = 1
+	exitError   = 2
+
+	admissionReviewKind = "AdmissionReview"
+)
+
+// manifest is the part of an object identifying it
+type manifest struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+}
+
+func main() {
+	namespace := flag.String("namespace", "default", "Namespace of the manifests which do not set one.")
+	policyFile := flag.String("policy-file", "", "YAML or JSON file of the cluster network policy to replay against, namespace selectors never match offline.")
+	invalidIPAM := flag.String("invalid-ipam", webhook.IPAMWarn, "Action on net-attach-defs with invalid IPAM sections to replay with, deny or warn.")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] FILE...\n\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Replays AdmissionReview JSON files, or NetworkAttachmentDefinition and Pod\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "YAML or JSON manifests, through the admission validation. - reads stdin.\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "Exits with 1 when a request is denied, 2 on errors.\n\n")
+		flag.PrintDefaults()
+	}
+	// log to stderr rather than to files in $TMPDIR, -logtostderr=false restores the files
+	if err := flag.Set("logtostderr", "true"); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(exitError)
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(exitError)
+	}
+	if err := webhook.SetIPAMValidation(*invalidIPAM); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(exitError)
+	}
+	if *policyFile != "" {
+		if err := webhook.LoadPolicy(*policyFile); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(exitError)
+		}
+	}
+
+	status := exitAllowed
+	for _, path := range flag.Args() {
+		if fileStatus := replayFile(path, *namespace); fileStatus > status {
+			status = fileStatus
+		}
+	}
+	os.Exit(status)
+}
+
+// replayFile replays every document of the file and returns the exit status it calls for
+func replayFile(path, namespace string) int {
+	var in io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			return exitError
+		}
+		defer file.Close()
+		in = file
+	}
+
+	status := exitAllowed
+	decoder := utilyaml.NewYAMLOrJSONDecoder(in, 4096)
+	for {
+		var raw runtime.RawExtension
+		if err := decoder.Decode(&raw); err != nil {
+			if err == io.EOF {
+				return status
+			}
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			return exitError
+		}
+		raw.Raw = bytes.TrimSpace(raw.Raw)
+		if len(raw.Raw) == 0 || bytes.Equal(raw.Raw, []byte("null")) {
+			continue
+		}
+		if docStatus := replayDocument(path, namespace, raw.Raw); docStatus > status {
+			status = docStatus
+		}
+	}
+}
+
+// replayDocument replays an admission review or a manifest and prints the verdict
+func replayDocument(path, namespace string, doc []byte) int {
+	ar, err := admissionReviewFor(doc, namespace)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		return exitError
+	}
+	if err := webhook.Review(ar); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		return exitError
+	}
+
+	object := fmt.Sprintf("%s %s/%s", ar.Request.Kind.Kind, ar.Request.Namespace, ar.Request.Name)
+	if ar.Response.Allowed {
+		fmt.Printf("%s: %s: allowed\n", path, object)
+		for _, warning := range ar.Response.Warnings {
+			fmt.Printf("%s: %s: warning: %s\n", path, object, warning)
+		}
+		return exitAllowed
+	}
+	message := ""
+	if ar.Response.Result != nil {
+		message = ar.Response.Result.Message
+	}
+	if rule, ok := ar.Response.AuditAnnotations["rule"]; ok {
+		message = fmt.Sprintf("%s [%s]", message, rule)
+	}
+	fmt.Printf("%s: %s: denied: %s\n", path, object, message)
+	return exitDenied
+}
+
+// admissionReviewFor returns the recorded admission review, or the review of the creation
+// of the object for a manifest
+func admissionReviewFor(doc []byte, namespace string) (*v1beta1.AdmissionReview, error) {
+	var m manifest
+	if err := json.Unmarshal(doc, &m); err != nil {
+		return nil, err
+	}
+
+	if m.Kind == admissionReviewKind {
+		ar := &v1beta1.AdmissionReview{}
+		if err := json.Unmarshal(doc, ar); err != nil {
+			return nil, err
+		}
+		return ar, nil
+	}
+
+	if m.Kind == "" {
+		return nil, fmt.Errorf("document has no kind")
+	}
+	if m.Namespace != "" {
+		namespace = m.Namespace
+	}
+	name := m.Name
+	if name == "" {
+		name = m.GenerateName
+	}
+	gvk := schema.FromAPIVersionAndKind(m.APIVersion, m.Kind)
+	return &v1beta1.AdmissionReview{
+		Request: &v1beta1.AdmissionRequest{
+			UID:       "replay",
+			Kind:      metav1.GroupVersionKind{Group: gvk.Group, Version: gvk.Version, Kind: gvk.Kind},
+			Namespace: namespace,
+			Name:      name,
+			Operation: v1beta1.Create,
+			Object:    runtime.RawExtension{Raw: doc},
+		},
+	}, nil
+}
@@ -24,22 +24,30 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/golang/glog"
 	"github.com/k8snetworkplumbingwg/net-attach-def-admission-controller/pkg/controller"
+	"github.com/k8snetworkplumbingwg/net-attach-def-admission-controller/pkg/exemption"
 	"github.com/k8snetworkplumbingwg/net-attach-def-admission-controller/pkg/localmetrics"
 	"github.com/k8snetworkplumbingwg/net-attach-def-admission-controller/pkg/webhook"
+	netattachdefClientset "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/client/clientset/versioned"
+	netattachdefInformers "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/client/informers/externalversions"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	utilwait "k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 const (
 	metricsPath = "/metrics"
 	healthzPath = "/healthz"
+	// nadResyncPeriod is the resync period of the net-attach-def informer
+	nadResyncPeriod = time.Hour
 )
 
 func main() {
@@ -50,6 +58,36 @@ func main() {
 	cert := flag.String("tls-cert-file", "cert.pem", "File containing the default x509 Certificate for HTTPS.")
 	key := flag.String("tls-private-key-file", "key.pem", "File containing the default x509 private key matching --tls-cert-file.")
 	ignoreNamespaces := flag.String("ignore-namespaces", "", "Comma separated namespace list to ignore pod update")
+	controllerWorkers := flag.Int("controller-workers", 2, "Number of workers processing pod updates for metrics.")
+	enabledInstanceTypes := flag.String("enabled-instance-types", strings.Join(localmetrics.DefaultEnabledInstanceTypes, ","),
+		"Comma separated network types reported by the network_attachment_definition_enabled_instance_up metric, besides any.")
+	unusedGracePeriod := flag.Duration("unused-nad-grace-period", 0, "Report net-attach-defs not used by any running pod for this long, 0 disables the detection.")
+	auditInterval := flag.Duration("audit-interval", 0, "Period of the re-validation of existing net-attach-defs against the admission rules, e.g. 10m, 0 disables the audit.")
+	auditPods := flag.Bool("audit-pods", false, "Also audit running pods against the isolation rules of the /isolate webhook.")
+	trackStuckPods := flag.Bool("track-stuck-pods", false, "Watch pending pods and their sandbox failure events to count failed network attachments.")
+	recordDenialEvents := flag.Bool("record-denial-events", false, "Record an event on the namespace of denied net-attach-def and pod requests.")
+	decisionLog := flag.String("decision-log", "", "File the admission decisions are logged to as JSON lines, - for the standard output, empty disables the log.")
+	decisionLogMaxSize := flag.Int("decision-log-max-size", 100, "Size in megabytes at which the decision log file is rotated.")
+	decisionLogMaxBackups := flag.Int("decision-log-max-backups", 3, "Number of rotated decision log files kept.")
+	exemptNamespaces := flag.String("exempt-namespaces", "", "Comma separated namespace list exempt from the webhooks and the audit.")
+	exemptNamespaceSelector := flag.String("exempt-namespace-selector", "", "Label selector of the namespaces exempt from the webhooks and the audit.")
+	exemptUsers := flag.String("exempt-users", "", "Comma separated list of users whose requests are exempt from the webhooks.")
+	exemptGroups := flag.String("exempt-groups", "", "Comma separated list of groups whose requests are exempt from the webhooks.")
+	exemptServiceAccounts := flag.String("exempt-service-accounts", "", "Comma separated list of namespace/name service accounts whose requests are exempt from the webhooks, a name of * exempts all service accounts of the namespace.")
+	exemptObjectSelector := flag.String("exempt-object-selector", "", "Label selector of the net-attach-defs and pods exempt from the webhooks and the audit. "+
+		"WARNING: whoever may create or label a pod or net-attach-def can exempt it from all enforcement by setting matching labels.")
+	policyFile := flag.String("policy-file", "", "YAML or JSON file of the cluster network policy enforced on net-attach-defs, empty enforces none.")
+	podCIDRs := flag.String("pod-cidrs", "", "Comma separated pod network CIDRs net-attach-defs must not overlap.")
+	serviceCIDRs := flag.String("service-cidrs", "", "Comma separated service network CIDRs net-attach-defs must not overlap.")
+	discoverNodeNetworks := flag.Bool("discover-node-networks", false, "Discover the pod CIDRs and internal addresses of the nodes as networks net-attach-defs must not overlap.")
+	clusterNetworkOverlap := flag.String("cluster-network-overlap", webhook.OverlapWarn, "Action on net-attach-defs overlapping the cluster networks, deny or warn.")
+	invalidIPAM := flag.String("invalid-ipam", webhook.IPAMWarn, "Action on net-attach-defs with malformed subnets, addresses or routes in their IPAM sections, deny or warn.")
+	maxNetAttachDefs := flag.Int("max-net-attach-defs-per-namespace", 0, "Maximum number of net-attach-defs of a namespace, 0 for no limit.")
+	maxAttachments := flag.Int("max-attachments-per-pod", 0, "Maximum number of networks a pod attaches to, 0 for no limit.")
+	maxPods := flag.Int("max-pods-per-net-attach-def", 0, "Maximum number of pending or running pods attached to a net-attach-def, 0 for no limit.")
+	annotateUnused := flag.Bool("annotate-unused-nads", false, "Annotate net-attach-defs reported unused with the time they are unused since.")
+	serveMissingReferences := flag.Bool("serve-missing-references", false, "Serve the pods referencing missing net-attach-defs on "+controller.MissingReferencesPath+
+		" of the metrics server. The list names pods of all namespaces and is not authenticated.")
 	flag.Parse()
 
 	glog.Infof("starting net-attach-def-admission-controller webhook server")
@@ -67,6 +105,26 @@ func main() {
 	// Register metrics
 	prometheus.MustRegister(localmetrics.NetAttachDefInstanceCounter)
 	prometheus.MustRegister(localmetrics.NetAttachDefEnabledInstanceUp)
+	prometheus.MustRegister(localmetrics.NetAttachDefNamespaceInstanceCounter)
+	prometheus.MustRegister(localmetrics.NetAttachDefPodCounter)
+	prometheus.MustRegister(localmetrics.NetAttachDefAttachmentCounter)
+	prometheus.MustRegister(localmetrics.NetAttachDefNodeInstanceCounter)
+	prometheus.MustRegister(localmetrics.NetAttachDefUnused)
+	prometheus.MustRegister(localmetrics.NetAttachDefMissingReferenceCounter)
+	prometheus.MustRegister(localmetrics.NetAttachDefNotAttachedCounter)
+	prometheus.MustRegister(localmetrics.NetAttachDefPodInterfacesCounter)
+	prometheus.MustRegister(localmetrics.NetAttachDefIPsInUseCounter)
+	prometheus.MustRegister(localmetrics.NetAttachDefIPRangeSize)
+	prometheus.MustRegister(localmetrics.NetAttachDefIPRangeInUse)
+	prometheus.MustRegister(localmetrics.NetAttachDefIPRangeUtilization)
+	prometheus.MustRegister(localmetrics.NetAttachDefDuplicateIPs)
+	prometheus.MustRegister(localmetrics.NetAttachDefAttachmentFailures)
+	prometheus.MustRegister(localmetrics.NetAttachDefStuckPodAge)
+	prometheus.MustRegister(localmetrics.NetAttachDefAuditViolations)
+	prometheus.MustRegister(localmetrics.NetAttachDefPodAuditViolations)
+	prometheus.MustRegister(localmetrics.NetAttachDefAuditLastRun)
+	prometheus.MustRegister(localmetrics.NetAttachDefAuditDuration)
+	prometheus.MustRegister(localmetrics.NetAttachDefExemptions)
 
 	// Including these stats kills performance when Prometheus polls with multiple targets
 	prometheus.Unregister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
@@ -74,11 +132,93 @@ func main() {
 
 	/* init API client */
 	webhook.SetupInClusterClient()
+	if *recordDenialEvents {
+		webhook.EnableDenialEvents()
+	}
+	if *decisionLog != "" {
+		if err := webhook.EnableDecisionLog(*decisionLog, int64(*decisionLogMaxSize)*1024*1024, *decisionLogMaxBackups); err != nil {
+			glog.Fatalf("failed to open decision log: %v", err)
+		}
+	}
+	if *policyFile != "" {
+		if err := webhook.LoadPolicy(*policyFile); err != nil {
+			glog.Fatalf("failed to load policy: %v", err)
+		}
+	}
+	// namespaces choose their policy and may be exempt by their labels
+	if err := webhook.StartNamespaceInformer(utilwait.NeverStop); err != nil {
+		glog.Fatalf("failed to watch namespaces: %v", err)
+	}
+	// the webhook and the controller share one cache of the net-attach-defs
+	nadInformer := newNetAttachDefInformer()
+	// net-attach-defs of other namespaces may claim the VLANs of a net-attach-def
+	if err := webhook.WatchNetworkAttachmentDefinitions(nadInformer, utilwait.NeverStop); err != nil {
+		glog.Fatalf("failed to watch net-attach-defs: %v", err)
+	}
+	if err := webhook.SetIPAMValidation(*invalidIPAM); err != nil {
+		glog.Fatalf("invalid IPAM validation: %v", err)
+	}
+	if *podCIDRs != "" || *serviceCIDRs != "" || *discoverNodeNetworks {
+		if err := webhook.SetClusterNetworks(splitList(*podCIDRs), splitList(*serviceCIDRs), *clusterNetworkOverlap); err != nil {
+			glog.Fatalf("invalid cluster networks: %v", err)
+		}
+		if *discoverNodeNetworks {
+			if err := webhook.StartNodeInformer(utilwait.NeverStop); err != nil {
+				glog.Fatalf("failed to watch nodes: %v", err)
+			}
+		}
+	}
+	if err := webhook.SetQuotas(webhook.Quotas{
+		NetAttachDefsPerNamespace: *maxNetAttachDefs,
+		AttachmentsPerPod:         *maxAttachments,
+		PodsPerNetAttachDef:       *maxPods,
+	}); err != nil {
+		glog.Fatalf("invalid quotas: %v", err)
+	}
+	exemptionConfig, err := exemption.ParseConfig(*exemptNamespaces, *exemptNamespaceSelector,
+		*exemptUsers, *exemptGroups, *exemptServiceAccounts, *exemptObjectSelector)
+	if err != nil {
+		glog.Fatalf("invalid exemptions: %v", err)
+	}
+	if exemptionConfig.ObjectSelector != nil && !exemptionConfig.ObjectSelector.Empty() {
+		glog.Warningf("net-attach-defs and pods labeled %s are exempt from all enforcement, their creators can label them so", exemptionConfig.ObjectSelector)
+	}
+	exemptions := exemption.New(exemptionConfig, webhook.NamespaceLabels)
+	webhook.SetExemptions(exemptions)
+
 	// start metrics sever
-	startHTTPMetricServer(*metricsAddress)
+	metricsMux := startHTTPMetricServer(*metricsAddress, *serveMissingReferences)
+	var debugMux *http.ServeMux
+	if *serveMissingReferences {
+		debugMux = metricsMux
+	}
 
 	//Start watching for pod creations
-	go controller.StartWatching(ignoreNamespaces)
+	if *controllerWorkers < 1 {
+		glog.Fatalf("invalid number of controller workers: %d", *controllerWorkers)
+	}
+	// the webhook limits the pods per net-attach-def with the pods counted by the controller,
+	// the pods are only counted when the limit is set
+	var podCounterReady func(controller.PodCounter)
+	if *maxPods > 0 {
+		podCounterReady = func(counter controller.PodCounter) {
+			webhook.SetPodCounter(webhook.PodCounter(counter))
+		}
+	}
+	go controller.StartWatching(controller.Options{
+		IgnoreNamespaces:     *ignoreNamespaces,
+		Workers:              *controllerWorkers,
+		EnabledInstanceTypes: strings.Split(*enabledInstanceTypes, ","),
+		UnusedGracePeriod:    *unusedGracePeriod,
+		AnnotateUnused:       *annotateUnused,
+		TrackStuckPods:       *trackStuckPods,
+		AuditInterval:        *auditInterval,
+		AuditPods:            *auditPods,
+		Exemptions:           exemptions,
+		DebugMux:             debugMux,
+		NetAttachDefInformer: nadInformer,
+		PodCounterReady:      podCounterReady,
+	})
 
 	go func() {
 		/* register handlers */
@@ -87,6 +227,8 @@ func main() {
 
 		http.HandleFunc("/isolate", webhook.IsolateHandler)
 
+		http.HandleFunc("/evaluate", webhook.EvaluateHandler)
+
 		/* start serving */
 		httpServer = &http.Server{
 			Addr: fmt.Sprintf("%s:%d", *address, *port),
@@ -123,7 +265,7 @@ func main() {
 
 }
 
-func startHTTPMetricServer(metricsAddress string) {
+func startHTTPMetricServer(metricsAddress string, serveMissingReferences bool) *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.Handle(metricsPath, promhttp.Handler())
 
@@ -133,6 +275,10 @@ func startHTTPMetricServer(metricsAddress string) {
 		w.Write([]byte(http.StatusText(http.StatusOK)))
 	})
 	// Add index
+	missingReferencesLink := ""
+	if serveMissingReferences {
+		missingReferencesLink = `<li><a href='` + controller.MissingReferencesPath + `'>pods referencing missing network attachment definitions</a></li>`
+	}
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
 		 <head><title>Net Attach Definition Admission Controller Metrics Server</title></head>
@@ -141,6 +287,7 @@ func startHTTPMetricServer(metricsAddress string) {
 		 <ul>
 		 <li><a href='` + metricsPath + `'>metrics</a></li>
 		 <li><a href='` + healthzPath + `'>healthz</a></li>
+		 ` + missingReferencesLink + `
 		 </ul>
 		 </body>
 		 </html>`))
@@ -153,4 +300,29 @@ func startHTTPMetricServer(metricsAddress string) {
 		}
 	}, 5*time.Second, utilwait.NeverStop)
 
+	return mux
+}
+
+// newNetAttachDefInformer starts the informer of the net-attach-defs of the cluster
+func newNetAttachDefInformer() cache.SharedIndexInformer {
+	config, err := clientcmd.BuildConfigFromFlags("", os.Getenv("KUBECONFIG"))
+	if err != nil {
+		glog.Fatal(err)
+	}
+	nadClient, err := netattachdefClientset.NewForConfig(config)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	factory := netattachdefInformers.NewSharedInformerFactory(nadClient, nadResyncPeriod)
+	informer := factory.K8sCniCncfIo().V1().NetworkAttachmentDefinitions().Informer()
+	factory.Start(utilwait.NeverStop)
+	return informer
+}
+
+// splitList splits a comma separated flag value, an empty value is an empty list
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
 }
@@ -27,11 +27,13 @@ if [ "$GO111MODULE" == "off" ]; then
 
 	# go install ./...
 	go build -o ./bin/webhook ${REPO_PATH}/cmd/webhook
+	go build -o ./bin/replay ${REPO_PATH}/cmd/replay
 else
         # build with go modules
         export GO111MODULE=on
 
         echo "Building admission controller"
         go build -o ${DEST_DIR}/webhook -tags no_openssl -ldflags "${LDFLAGS}" "$@" ./cmd/webhook
+        go build -o ${DEST_DIR}/replay -tags no_openssl -ldflags "${LDFLAGS}" "$@" ./cmd/replay
 fi
 # go install ./...
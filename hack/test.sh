@@ -1,2 +1,2 @@
 #!/bin/bash
-go test -v -covermode=count -coverprofile=coverage.out ./...
+go test -v -race -covermode=atomic -coverprofile=coverage.out ./...
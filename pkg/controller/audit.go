@@ -0,0 +1,195 @@
+// Copyright (c) 2022 Network Plumbing Working Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/k8snetworkplumbingwg/net-attach-def-admission-controller/pkg/exemption"
+	"github.com/k8snetworkplumbingwg/net-attach-def-admission-controller/pkg/localmetrics"
+	"github.com/k8snetworkplumbingwg/net-attach-def-admission-controller/pkg/webhook"
+	networkv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	api_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// violationsAnnotation lists the rules an existing net-attach-def violates, as found by the audit
+	violationsAnnotation = "netattach.k8s.cni.cncf.io/violations"
+)
+
+// audit runs the periodic audit of the net-attach-defs and, if enabled, of the running pods
+func (c *Controller) audit() {
+	c.auditNetworkAttachmentDefinitions()
+	if c.auditPodsEnabled {
+		c.auditPods()
+	}
+}
+
+// auditNetworkAttachmentDefinitions re-validates every net-attach-def against the admission
+// rules, so the ones created while the webhook was down or before a rule existed are reported.
+func (c *Controller) auditNetworkAttachmentDefinitions() {
+	start := time.Now()
+	ruleCounts := make(map[string]int)
+	audited := make(map[string]string)
+
+	for _, obj := range c.nadInformer.GetStore().List() {
+		nad, ok := obj.(*networkv1.NetworkAttachmentDefinition)
+		if !ok {
+			continue
+		}
+		key := nad.Namespace + "/" + nad.Name
+		var violations []webhook.Violation
+		if !c.auditExempt(nad.Namespace, nad.Labels) {
+			violations = webhook.AuditNetworkAttachmentDefinition(*nad)
+		}
+
+		var value string
+		if len(violations) > 0 {
+			valueBytes, err := json.Marshal(violations)
+			if err != nil {
+				glog.Errorf("failed to marshal audit violations of net-attach-def %s: %v", key, err)
+				continue
+			}
+			value = string(valueBytes)
+			audited[key] = value
+			for _, violation := range violations {
+				ruleCounts[violation.Rule]++
+			}
+		}
+
+		if value != c.audited[key] && value != "" {
+			glog.Infof("net-attach-def %s violates admission rules: %s", key, value)
+			messages := make([]string, 0, len(violations))
+			for _, violation := range violations {
+				messages = append(messages, violation.Rule+": "+violation.Message)
+			}
+			c.recorder.Eventf(nad, api_v1.EventTypeWarning, "PolicyViolation",
+				"Audit found admission rule violations: %s", strings.Join(messages, "; "))
+		} else if value == "" && c.audited[key] != "" {
+			glog.Infof("net-attach-def %s no longer violates admission rules", key)
+		}
+		c.syncViolationsAnnotation(nad, value)
+	}
+
+	for rule, count := range ruleCounts {
+		localmetrics.SetNetAttachDefAuditViolations(rule, count)
+	}
+	for rule := range c.auditRuleCounts {
+		if _, ok := ruleCounts[rule]; !ok {
+			localmetrics.SetNetAttachDefAuditViolations(rule, 0)
+		}
+	}
+	c.audited = audited
+	c.auditRuleCounts = ruleCounts
+	localmetrics.SetNetAttachDefAuditRun(start, time.Since(start))
+	glog.V(4).Infof("audited net-attach-defs in %s, %d in violation", time.Since(start), len(audited))
+}
+
+// auditExempt tells whether the audited object is exempt from enforcement,
+// exempt objects are reported as free of violations. Unlike admission requests,
+// they are neither logged nor counted, the audit would do so at every interval
+func (c *Controller) auditExempt(namespace string, objectLabels map[string]string) bool {
+	return c.exemptions.Reason(exemption.Subject{Namespace: namespace, Labels: objectLabels}) != ""
+}
+
+// syncViolationsAnnotation sets, updates or removes the violations annotation of the net-attach-def
+func (c *Controller) syncViolationsAnnotation(nad *networkv1.NetworkAttachmentDefinition, value string) {
+	if nad.GetAnnotations()[violationsAnnotation] == value {
+		return
+	}
+
+	var annotation interface{} // null removes the annotation
+	if value != "" {
+		annotation = value
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{violationsAnnotation: annotation},
+		},
+	})
+	if err != nil {
+		glog.Errorf("failed to prepare annotation patch for net-attach-def %s/%s: %v", nad.Namespace, nad.Name, err)
+		return
+	}
+	_, err = c.nadClientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions(nad.Namespace).Patch(context.TODO(),
+		nad.Name, k8stypes.MergePatchType, patch, meta_v1.PatchOptions{})
+	if err != nil {
+		glog.Errorf("failed to update %s annotation of net-attach-def %s/%s: %v", violationsAnnotation, nad.Namespace, nad.Name, err)
+	}
+}
+
+// podRuleKey identifies the pod violation count of a rule in a namespace
+type podRuleKey struct {
+	namespace string
+	rule      string
+}
+
+// auditPods checks the networks annotation of running pods against the current isolation rules,
+// so pods attaching networks of other namespaces from before the enforcement are reported.
+func (c *Controller) auditPods() {
+	ruleCounts := make(map[podRuleKey]int)
+	audited := make(map[string]string)
+
+	for _, obj := range c.informer.GetStore().List() {
+		pod, ok := obj.(*api_v1.Pod)
+		if !ok || !c.handles(pod) {
+			continue
+		}
+		if _, ok := pod.GetAnnotations()[nadPodAnnotation]; !ok {
+			continue
+		}
+		key := pod.Namespace + "/" + pod.Name
+		var violations []webhook.Violation
+		if !c.auditExempt(pod.Namespace, pod.Labels) {
+			violations = webhook.AuditPod(*pod)
+		}
+		if len(violations) == 0 {
+			if c.auditedPods[key] != "" {
+				glog.Infof("pod %s no longer violates isolation rules", key)
+			}
+			continue
+		}
+
+		messages := make([]string, 0, len(violations))
+		for _, violation := range violations {
+			messages = append(messages, violation.Rule+": "+violation.Message)
+			ruleCounts[podRuleKey{namespace: pod.Namespace, rule: violation.Rule}]++
+		}
+		value := strings.Join(messages, "; ")
+		audited[key] = value
+		if value != c.auditedPods[key] {
+			glog.Infof("pod %s violates isolation rules: %s", key, value)
+			c.recorder.Eventf(pod, api_v1.EventTypeWarning, "PolicyViolation",
+				"Audit found isolation rule violations: %s", value)
+		}
+	}
+
+	for ruleKey, count := range ruleCounts {
+		localmetrics.SetNetAttachDefPodAuditViolations(ruleKey.namespace, ruleKey.rule, count)
+	}
+	for ruleKey := range c.auditPodRuleCounts {
+		if _, ok := ruleCounts[ruleKey]; !ok {
+			localmetrics.SetNetAttachDefPodAuditViolations(ruleKey.namespace, ruleKey.rule, 0)
+		}
+	}
+	c.auditedPods = audited
+	c.auditPodRuleCounts = ruleCounts
+}
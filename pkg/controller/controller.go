@@ -18,6 +18,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"regexp"
@@ -30,16 +31,23 @@ import (
 	"github.com/golang/glog"
 	"gopkg.in/k8snetworkplumbingwg/multus-cni.v3/pkg/logging"
 	"gopkg.in/k8snetworkplumbingwg/multus-cni.v3/pkg/types"
+	"github.com/k8snetworkplumbingwg/net-attach-def-admission-controller/pkg/exemption"
 	"github.com/k8snetworkplumbingwg/net-attach-def-admission-controller/pkg/localmetrics"
 	networkv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
 	netattachdefClientset "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/client/clientset/versioned"
+	netattachdefScheme "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/client/clientset/versioned/scheme"
+	netattachdefInformers "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/client/informers/externalversions/k8s.cni.cncf.io/v1"
 	api_v1 "k8s.io/api/core/v1"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 )
 
@@ -62,16 +70,88 @@ const (
 	// you can set it to zero for default
 )
 
+// Options ... configuration of the controller
+type Options struct {
+	// IgnoreNamespaces is a comma separated list of namespaces whose pods are not watched
+	IgnoreNamespaces string
+	// Workers is the number of workers processing pod updates
+	Workers int
+	// EnabledInstanceTypes are the network types reported by the enabled_instance_up metric besides "any"
+	EnabledInstanceTypes []string
+	// UnusedGracePeriod is how long a net-attach-def must not be referenced by any
+	// running pod to be reported unused, zero disables the detection
+	UnusedGracePeriod time.Duration
+	// AnnotateUnused also marks unused net-attach-defs with an annotation
+	AnnotateUnused bool
+	// DebugMux, if set, gets the debug endpoints of the controller registered
+	DebugMux *http.ServeMux
+	// TrackStuckPods also watches Pending pods and their sandbox failure events
+	TrackStuckPods bool
+	// AuditInterval is the period of the re-validation of all net-attach-defs, 0 disables the audit
+	AuditInterval time.Duration
+	// AuditPods also audits running pods against the isolation rules
+	AuditPods bool
+	// Exemptions are the namespaces and objects skipped by the audit, nil exempts nothing
+	Exemptions *exemption.Exemptions
+	// NetAttachDefInformer, if set, is the informer of the net-attach-defs shared with the
+	// webhook and started by its owner, the controller runs its own otherwise
+	NetAttachDefInformer cache.SharedIndexInformer
+	// PodCounterReady, if set, gets a counter of the admitted, non-terminal pods attached to
+	// each net-attach-def once the pods are synced, e.g. for the quotas of the webhook. The
+	// pods are counted from the pod informer of the controller, which then watches the
+	// non-terminal pods of all namespaces
+	PodCounterReady func(PodCounter)
+}
+
 // Controller object
 type Controller struct {
 	clientset    kubernetes.Interface
 	queue        workqueue.RateLimitingInterface
 	informer     cache.SharedIndexInformer
-	nadClientset *netattachdefClientset.Clientset
+	nadInformer  cache.SharedIndexInformer
+	nadIndex     *nadPodIndex
+	store        *localmetrics.ObjStore
+	nadClientset netattachdefClientset.Interface
+	recorder     record.EventRecorder
+	workers      int
+	startTime    time.Time
+	// unused holds the keys of net-attach-defs currently reported unused
+	unused            map[string]bool
+	unusedGracePeriod time.Duration
+	annotateUnused    bool
+	ipUsage           *ipUsage
+
+	// nadInformerShared tells the net-attach-def informer is started by its owner
+	nadInformerShared bool
+
+	// stuck pod tracking, nil unless enabled
+	pendingInformer cache.SharedIndexInformer
+	eventInformer   cache.SharedIndexInformer
+	stuckPods       *stuckPods
+
+	// informers of the pods of ignored namespaces, for the unused detection, and the
+	// net-attach-defs used by their pods
+	ignoredInformers []cache.SharedIndexInformer
+	ignoredIndex     *nadPodIndex
+
+	// pod counting, nil unless enabled. The pod informer then also holds pending pods and
+	// the pods of ignored namespaces, which the controller skips
+	podCounterReady   func(PodCounter)
+	ignoredNamespaces map[string]bool
+
+	// audit state, only used by the audit loop
+	auditInterval   time.Duration
+	audited         map[string]string
+	auditRuleCounts map[string]int
+
+	auditPodsEnabled   bool
+	exemptions         *exemption.Exemptions
+	auditedPods        map[string]string
+	auditPodRuleCounts map[podRuleKey]int
 }
 
 //StartWatching ...  Start prepares watchers and run their controllers, then waits for process termination signals
-func StartWatching(ignoreNamespaces *string) {
+func StartWatching(opts Options) {
 	var clientset kubernetes.Interface
 
 	/* setup Kubernetes API client */
@@ -90,22 +170,83 @@ func StartWatching(ignoreNamespaces *string) {
 		glog.Fatalf("There was error accessing client set for net attach def %v", err)
 	}
 	//Initialize default metrics
-	localmetrics.InitMetrics()
+	localmetrics.InitMetrics(opts.EnabledInstanceTypes)
 
 	// add fieldSelector to filter the non-target namespaces
-	fieldSelector := "status.phase==Running"
-	if ignoreNamespaces != nil && len(*ignoreNamespaces) != 0 {
-		for _, ns := range strings.Split(*ignoreNamespaces, ",") {
+	namespaceSelector := ""
+	var ignoredNamespaces []string
+	if len(opts.IgnoreNamespaces) != 0 {
+		for _, ns := range strings.Split(opts.IgnoreNamespaces, ",") {
 			if len(ns) != 0 {
-				fieldSelector = fmt.Sprintf("%s,metadata.namespace!=%s", fieldSelector, ns)
+				namespaceSelector = fmt.Sprintf("%s,metadata.namespace!=%s", namespaceSelector, ns)
+				ignoredNamespaces = append(ignoredNamespaces, ns)
 			}
 		}
 	}
 
-	informer := cache.NewSharedIndexInformer(
+	podFieldSelector := "status.phase==Running" + namespaceSelector
+	if opts.PodCounterReady != nil {
+		// pods of ignored namespaces attach net-attach-defs too, the pods are counted
+		// with the informer of the controller rather than a second watch
+		podFieldSelector = nonTerminalFieldSelector
+	}
+	informer := newPodInformer(clientset, api_v1.NamespaceAll, podFieldSelector)
+
+	nadInformer := opts.NetAttachDefInformer
+	if nadInformer == nil {
+		nadInformer = netattachdefInformers.NewNetworkAttachmentDefinitionInformer(
+			nadClientset,
+			api_v1.NamespaceAll,
+			resyncPeriod,
+			cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
+		)
+	}
+
+	c := newResourceController(clientset, nadClientset, informer, nadInformer, newEventRecorder(clientset), opts)
+	c.nadInformerShared = opts.NetAttachDefInformer != nil
+	if opts.TrackStuckPods {
+		eventInformer := cache.NewSharedIndexInformer(
+			cache.NewFilteredListWatchFromClient(
+				clientset.CoreV1().RESTClient(),
+				"events", api_v1.NamespaceAll, func(options *meta_v1.ListOptions) {
+					options.FieldSelector = sandboxFailureFieldSelector
+				},
+			),
+			&api_v1.Event{},
+			resyncPeriod,
+			cache.Indexers{},
+		)
+		c.EnableStuckPodTracking(newPodInformer(clientset, api_v1.NamespaceAll, "status.phase==Pending"+namespaceSelector), eventInformer)
+	}
+	if opts.UnusedGracePeriod > 0 {
+		// the pods of ignored namespaces still use net-attach-defs
+		for _, ns := range ignoredNamespaces {
+			c.TrackIgnoredUsage(newPodInformer(clientset, ns, "status.phase==Running"))
+		}
+	}
+	if opts.PodCounterReady != nil {
+		if err := c.EnablePodCounting(ignoredNamespaces, opts.PodCounterReady); err != nil {
+			glog.Fatalf("failed to count pods: %v", err)
+		}
+	}
+	if opts.DebugMux != nil {
+		opts.DebugMux.HandleFunc(MissingReferencesPath, c.missingReferencesHandler)
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go c.Run(stopCh)
+
+	sigterm := make(chan os.Signal, 1)
+	signal.Notify(sigterm, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
+	<-sigterm
+}
+
+// newPodInformer returns an informer of the pods of the namespace matching the field selector
+func newPodInformer(clientset kubernetes.Interface, namespace, fieldSelector string) cache.SharedIndexInformer {
+	return cache.NewSharedIndexInformer(
 		cache.NewFilteredListWatchFromClient(
 			clientset.CoreV1().RESTClient(),
-			"pods", api_v1.NamespaceAll, func(options *meta_v1.ListOptions) {
+			"pods", namespace, func(options *meta_v1.ListOptions) {
 				options.FieldSelector = fieldSelector
 			},
 		),
@@ -113,20 +254,39 @@ func StartWatching(ignoreNamespaces *string) {
 		resyncPeriod,
 		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}, // use default indexer
 	)
-
-	c := newResourceController(clientset, nadClientset, informer)
-	stopCh := make(chan struct{})
-	defer close(stopCh)
-	go c.Run(stopCh)
-
-	sigterm := make(chan os.Signal, 1)
-	signal.Notify(sigterm, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
-	<-sigterm
 }
 
-func newResourceController(client kubernetes.Interface, nadClient *netattachdefClientset.Clientset,
-	informer cache.SharedIndexInformer) *Controller {
+func newResourceController(client kubernetes.Interface, nadClient netattachdefClientset.Interface,
+	informer cache.SharedIndexInformer, nadInformer cache.SharedIndexInformer, recorder record.EventRecorder, opts Options) *Controller {
 	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	nadIndex := newNadPodIndex()
+	c := &Controller{
+		clientset:    client,
+		nadClientset: nadClient,
+		informer:     informer,
+		nadInformer:  nadInformer,
+		nadIndex:     nadIndex,
+		ignoredIndex: newNadPodIndex(),
+		store:        localmetrics.NewObjStore(),
+		recorder:     recorder,
+		queue:        queue,
+		workers:      opts.Workers,
+		startTime:    time.Now(),
+
+		unused:            make(map[string]bool),
+		unusedGracePeriod: opts.UnusedGracePeriod,
+		annotateUnused:    opts.AnnotateUnused,
+		ipUsage:           newIPUsage(),
+
+		auditInterval:   opts.AuditInterval,
+		audited:         make(map[string]string),
+		auditRuleCounts: make(map[string]int),
+
+		auditPodsEnabled:   opts.AuditPods,
+		exemptions:         opts.Exemptions,
+		auditedPods:        make(map[string]string),
+		auditPodRuleCounts: make(map[podRuleKey]int),
+	}
 
 	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
@@ -186,12 +346,53 @@ func newResourceController(client kubernetes.Interface, nadClient *netattachdefC
 		},
 	})
 
-	return &Controller{
-		clientset:    client,
-		nadClientset: nadClient,
-		informer:     informer,
-		queue:        queue,
+	// enqueue all pods referencing a net-attach-def when it is added, changed or removed,
+	// so the metrics follow the current config types without waiting for a resync
+	enqueueReferencingPods := func(obj interface{}) {
+		nadKey, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+		if err != nil {
+			utilruntime.HandleError(err)
+			return
+		}
+		for _, podKey := range nadIndex.podsFor(nadKey) {
+			queue.Add(podKey)
+		}
+		// address ranges may have changed as well
+		c.syncIPRangeMetrics(nadKey)
 	}
+	nadInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: enqueueReferencingPods,
+		UpdateFunc: func(oldN, newN interface{}) {
+			oldNad, okOld := oldN.(*networkv1.NetworkAttachmentDefinition)
+			newNad, okNew := newN.(*networkv1.NetworkAttachmentDefinition)
+			// only the config decides the metrics, skip resyncs and metadata updates
+			if okOld && okNew && oldNad.Spec.Config == newNad.Spec.Config {
+				return
+			}
+			enqueueReferencingPods(newN)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if nadKey, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj); err == nil {
+				nadIndex.forget(nadKey)
+				c.ignoredIndex.forget(nadKey)
+			}
+			enqueueReferencingPods(obj)
+		},
+	})
+
+	return c
+}
+
+// newEventRecorder returns a recorder for events on pods and net-attach-defs
+func newEventRecorder(client kubernetes.Interface) record.EventRecorder {
+	eventScheme := runtime.NewScheme()
+	utilruntime.Must(clientgoscheme.AddToScheme(eventScheme))
+	utilruntime.Must(netattachdefScheme.AddToScheme(eventScheme))
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartLogging(glog.Infof)
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return broadcaster.NewRecorder(eventScheme, api_v1.EventSource{Component: "net-attach-def-admission-controller"})
 }
 
 // Run starts the kubewatch controller
@@ -202,20 +403,54 @@ func (c *Controller) Run(stopCh <-chan struct{}) {
 	glog.Info("Starting net-attach-def-admission-controller")
 
 	go c.informer.Run(stopCh)
+	if !c.nadInformerShared {
+		go c.nadInformer.Run(stopCh)
+	}
+	if c.stuckPods != nil {
+		go c.pendingInformer.Run(stopCh)
+		go c.eventInformer.Run(stopCh)
+	}
+	for _, informer := range c.ignoredInformers {
+		go informer.Run(stopCh)
+	}
 
 	if !cache.WaitForCacheSync(stopCh, c.HasSynced) {
 		utilruntime.HandleError(fmt.Errorf("Timed out waiting for caches to sync"))
 		return
 	}
 
-	glog.Info("net-attach-def-admission-controller synced and ready")
+	glog.Infof("net-attach-def-admission-controller synced and ready, starting %d workers", c.workers)
+	if c.podCounterReady != nil {
+		c.podCounterReady(c.countPods)
+	}
 
-	wait.Until(c.runWorker, time.Second, stopCh)
+	// the queue never hands out the same pod key to two workers at once,
+	// so per-pod bookkeeping in updateMetrics is not racing with itself
+	for i := 0; i < c.workers; i++ {
+		go wait.Until(c.runWorker, time.Second, stopCh)
+	}
+	if c.unusedGracePeriod > 0 {
+		go wait.Until(c.detectUnused, unusedCheckPeriod(c.unusedGracePeriod), stopCh)
+	}
+	if c.auditInterval > 0 {
+		go wait.Until(c.audit, c.auditInterval, stopCh)
+	}
+	if c.stuckPods != nil {
+		go wait.Until(c.syncStuckPods, stuckPodCheckPeriod, stopCh)
+	}
+	<-stopCh
 }
 
 // HasSynced is required for the cache.Controller interface.
 func (c *Controller) HasSynced() bool {
-	return c.informer.HasSynced()
+	synced := c.informer.HasSynced() && c.nadInformer.HasSynced()
+	if c.stuckPods != nil {
+		synced = synced && c.pendingInformer.HasSynced() && c.eventInformer.HasSynced()
+	}
+	for _, informer := range c.ignoredInformers {
+		synced = synced && informer.HasSynced()
+	}
+	return synced
 }
 
 // LastSyncResourceVersion is required for the cache.Controller interface.
@@ -279,25 +514,35 @@ func (c *Controller) processItem(key string) error {
 		return fmt.Errorf("Error fetching object with key %s from store: %v", key, err)
 	}
 	if !exists {
-		return c.updateMetrics(key, "", api_v1.NamespaceDefault, Delete)
+		c.ipUsage.forgetReported(key)
+		return c.updateMetrics(key, nil, Delete)
 	}
 
 	pod, _ := obj.(*api_v1.Pod)
 	namespace := pod.ObjectMeta.Namespace
-	if pod.Status.Phase == api_v1.PodRunning {
+	if c.handles(pod) {
 		glog.Infof("Pod found for net-attach-def metrics, processing %s under namespaces %s", key, namespace)
-		if name, ok := pod.GetAnnotations()[nadPodAnnotation]; ok {
-			return c.updateMetrics(key, name, namespace, Add)
+		if _, ok := pod.GetAnnotations()[nadPodAnnotation]; ok {
+			return c.updateMetrics(key, pod, Add)
 		}
 		//ok if annotation not found delete the metrics.
-		return c.updateMetrics(key, "", namespace, Delete)
+		c.ipUsage.forgetReported(key)
+		return c.updateMetrics(key, pod, Delete)
 	}
 
 	return nil
 }
 
-// find crd by name
+// find crd by name, the informer cache is used so that pods re-enqueued by
+// net-attach-def events see the same state as the event itself
 func (c *Controller) getCrdByName(name string, namespace string) (*networkv1.NetworkAttachmentDefinition, error) {
+	if c.nadInformer != nil {
+		obj, exists, err := c.nadInformer.GetIndexer().GetByKey(namespace + "/" + name)
+		if err != nil || !exists {
+			return nil, fmt.Errorf("Failed to locate network attachment definition %s/%s", namespace, name)
+		}
+		return obj.(*networkv1.NetworkAttachmentDefinition), nil
+	}
 	netAttachDef, err := c.nadClientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions(namespace).Get(context.TODO(), name, meta_v1.GetOptions{})
 	if err != nil {
 		return nil, fmt.Errorf("Failed to locate network attachment definition %s/%s", namespace, name)
@@ -306,7 +551,6 @@ func (c *Controller) getCrdByName(name string, namespace string) (*networkv1.Net
 }
 
 func (c *Controller) getConfigTypes(crd *networkv1.NetworkAttachmentDefinition) []string {
-	var confBytes []byte
 	var configTypes []string
 	set := make(map[string]struct{})
 
@@ -314,23 +558,7 @@ func (c *Controller) getConfigTypes(crd *networkv1.NetworkAttachmentDefinition)
 		// try to unmarshal config into NetworkConfig or NetworkConfigList
 		//  using actual code from libcni - if successful, it means that the config
 		//  will be accepted by CNI itself as well
-		confBytes = []byte(crd.Spec.Config)
-		networkConfigList, err := libcni.ConfListFromBytes(confBytes)
-
-		if err != nil { // if no error check for config
-			networkConfig, err := libcni.ConfFromBytes(confBytes)
-			if err == nil {
-				if _, found := set[networkConfig.Network.Type]; !found {
-					set[networkConfig.Network.Type] = struct{}{}
-				}
-			}
-		} else {
-			for _, plugin := range networkConfigList.Plugins {
-				if _, found := set[plugin.Network.Type]; !found {
-					set[plugin.Network.Type] = struct{}{}
-				}
-			}
-		}
+		addConfigTypes(set, []byte(crd.Spec.Config))
 		// Convert map to slice of keys.
 		for key := range set {
 			configTypes = append(configTypes, key)
@@ -339,51 +567,129 @@ func (c *Controller) getConfigTypes(crd *networkv1.NetworkAttachmentDefinition)
 	return configTypes
 }
 
-func (c *Controller) updateMetrics(key string, configNames string, namespace string, action metricAction) error {
+// delegatingConfig holds the delegates of thin wrapper plugins such as multus
+// ("delegates") or meta plugins like flannel ("delegate")
+type delegatingConfig struct {
+	Delegates []json.RawMessage `json:"delegates"`
+	Delegate  json.RawMessage   `json:"delegate"`
+}
+
+// addConfigTypes adds the plugin types of a network config or config list to the set
+func addConfigTypes(set map[string]struct{}, confBytes []byte) {
+	networkConfigList, err := libcni.ConfListFromBytes(confBytes)
+	if err != nil { // if no error check for config
+		networkConfig, err := libcni.ConfFromBytes(confBytes)
+		if err == nil {
+			addPluginType(set, networkConfig.Network.Type, networkConfig.Bytes)
+		}
+		return
+	}
+	for _, plugin := range networkConfigList.Plugins {
+		addPluginType(set, plugin.Network.Type, plugin.Bytes)
+	}
+}
+
+// addPluginType adds the plugin type to the set, for wrapper plugins the types of
+// their delegates are added instead, unless none of them can be parsed
+func addPluginType(set map[string]struct{}, pluginType string, pluginBytes []byte) {
+	var conf delegatingConfig
+	if err := json.Unmarshal(pluginBytes, &conf); err == nil {
+		delegateSet := make(map[string]struct{})
+		for _, delegate := range conf.Delegates {
+			addConfigTypes(delegateSet, delegate)
+		}
+		if len(conf.Delegate) != 0 {
+			addConfigTypes(delegateSet, conf.Delegate)
+		}
+		if len(delegateSet) != 0 {
+			for key := range delegateSet {
+				set[key] = struct{}{}
+			}
+			return
+		}
+	}
+	if pluginType != "" {
+		set[pluginType] = struct{}{}
+	}
+}
+
+// updateMetrics adds the metrics of the pod or, on Delete, reverts the ones stored for the pod key.
+// The pod is nil when it is already gone.
+func (c *Controller) updateMetrics(key string, pod *api_v1.Pod, action metricAction) error {
 	set := make(map[string]struct{})
 	var configTypes []string
 
 	switch action {
 	case Delete:
 		{
-			oldConfigs := localmetrics.GetStoredValue(key)
-			if oldConfigs != "" {
-				configTypes := strings.Split(oldConfigs, ",")
-				if len(configTypes) > 1 {
-					for _, val := range configTypes {
-						localmetrics.UpdateNetAttachDefInstanceMetrics(val, int(action))
+			if record, ok := c.store.GetStoredRecord(key); ok {
+				oldConfigs := record.ConfigTypes
+				if oldConfigs != "" {
+					configTypes := strings.Split(oldConfigs, ",")
+					if len(configTypes) > 1 {
+						for _, val := range configTypes {
+							localmetrics.UpdateNetAttachDefInstanceMetrics(val, int(action))
+						}
+						// decrement the metrics for old configs
+						localmetrics.UpdateNetAttachDefInstanceMetrics(oldConfigs, int(action))
+					} else {
+						localmetrics.UpdateNetAttachDefInstanceMetrics(configTypes[0], int(action))
 					}
-					// decrement the metrics for old configs
-					localmetrics.UpdateNetAttachDefInstanceMetrics(oldConfigs, int(action))
-				} else {
-					localmetrics.UpdateNetAttachDefInstanceMetrics(configTypes[0], int(action))
+					localmetrics.UpdateNetAttachDefInstanceMetrics("any", int(action))
 				}
-				localmetrics.UpdateNetAttachDefInstanceMetrics("any", int(action))
+				c.updateUsageMetrics(record, int(action))
+				c.updateIPUsage(key, pod, record, action)
 			}
-			localmetrics.SetStoredValue(key, "")
+			c.store.DeleteStoredRecord(key)
+			c.nadIndex.remove(key)
 		}
 	case Add: //create new pod event
 		{
+			namespace := pod.Namespace
 			//clean up
-			oldConfigs := localmetrics.GetStoredValue(key)
-			if oldConfigs != "" {
-				c.updateMetrics(key, "", namespace, Delete)
+			oldRecord, ok := c.store.GetStoredRecord(key)
+			if ok {
+				c.updateMetrics(key, pod, Delete)
 			}
 
-			networks, err := c.parsePodNetworkAnnotation(configNames, namespace)
+			networks, err := c.parsePodNetworkAnnotation(pod.GetAnnotations()[nadPodAnnotation], namespace)
 			if err != nil {
 				return fmt.Errorf("Error reading pod annotation %v", err)
 			}
+			// remember referenced net-attach-defs, including missing ones, so the pod
+			// is re-evaluated when any of them shows up, changes or goes away
+			nadKeys := make([]string, 0, len(networks))
+			for _, val := range networks {
+				nadKeys = append(nadKeys, val.Namespace+"/"+val.Name)
+			}
+			c.nadIndex.set(key, nadKeys)
+			record := localmetrics.PodRecord{
+				Namespace: namespace,
+				Node:      pod.Spec.NodeName,
+				Networks:  make(map[string]int),
+			}
 			for _, val := range networks { // create unique list
-				if crd, ok := c.getCrdByName(val.Name, val.Namespace); ok == nil {
-					for _, val := range c.getConfigTypes(crd) {
-						if _, found := set[val]; !found && val != "" {
-							set[val] = struct{}{}
-							configTypes = append(configTypes, val)
-						}
+				crd, err := c.getCrdByName(val.Name, val.Namespace)
+				if err != nil {
+					record.MissingNetworks = append(record.MissingNetworks, val.Namespace+"/"+val.Name)
+					continue
+				}
+				record.Networks[val.Namespace+"/"+val.Name]++
+				for _, val := range c.getConfigTypes(crd) {
+					if _, found := set[val]; !found && val != "" {
+						set[val] = struct{}{}
+						configTypes = append(configTypes, val)
 					}
 				}
 			}
+			c.reportMissingNetworks(pod, oldRecord.MissingNetworks, record.MissingNetworks)
+			statuses, hasStatus, err := parseNetworkStatus(pod)
+			if err != nil {
+				glog.Warningf("Ignoring network status of pod %s: %v", key, err)
+			} else if hasStatus {
+				record.HasStatus = true
+				addNetworkStatus(&record, statuses)
+			}
 			//unique network types metrics
 			for key := range set {
 				localmetrics.UpdateNetAttachDefInstanceMetrics(key, int(action))
@@ -393,20 +699,58 @@ func (c *Controller) updateMetrics(key string, configNames string, namespace str
 				sort.Strings(configTypes)
 				joinedTypes := strings.Join(configTypes, ",")
 				localmetrics.UpdateNetAttachDefInstanceMetrics(joinedTypes, int(action))
-				localmetrics.SetStoredValue(key, joinedTypes)
+				record.ConfigTypes = joinedTypes
 				//metrics for any combinations
 				localmetrics.UpdateNetAttachDefInstanceMetrics("any", int(action))
 			} else if len(configTypes) == 1 {
-				localmetrics.SetStoredValue(key, configTypes[0])
+				record.ConfigTypes = configTypes[0]
 				//metrics for any combinations
 				localmetrics.UpdateNetAttachDefInstanceMetrics("any", int(action))
 			}
+			c.updateUsageMetrics(record, int(action))
+			c.updateIPUsage(key, pod, record, action)
+			if record.ConfigTypes != "" || len(record.Networks) > 0 || len(record.MissingNetworks) > 0 || record.HasStatus {
+				c.store.SetStoredRecord(key, record)
+			}
 		}
 	}
 	return nil
 
 }
 
+// updateUsageMetrics updates per namespace, per node and per net-attach-def metrics of the pod record.
+// The stored record is used on delete, so a pod is always decremented on the node it was counted on.
+func (c *Controller) updateUsageMetrics(record localmetrics.PodRecord, val int) {
+	if record.Node != "" && record.ConfigTypes != "" {
+		for _, tp := range strings.Split(record.ConfigTypes, ",") {
+			localmetrics.UpdateNetAttachDefNodeMetrics(record.Node, tp, val)
+		}
+		localmetrics.UpdateNetAttachDefNodeMetrics(record.Node, "any", val)
+	}
+	if len(record.MissingNetworks) > 0 {
+		localmetrics.UpdateNetAttachDefMissingReferenceMetrics(record.Namespace, val*len(record.MissingNetworks))
+	}
+	if record.HasStatus {
+		localmetrics.UpdateNetAttachDefPodInterfacesMetrics(record.Interfaces, val)
+		for nadKey, missing := range record.NotAttached {
+			nadNamespace, nadName, _ := cache.SplitMetaNamespaceKey(nadKey)
+			localmetrics.UpdateNetAttachDefNotAttachedMetrics(nadNamespace, nadName, val*missing)
+		}
+		for nadKey, ips := range record.IPs {
+			nadNamespace, nadName, _ := cache.SplitMetaNamespaceKey(nadKey)
+			localmetrics.UpdateNetAttachDefIPsInUseMetrics(nadNamespace, nadName, val*len(ips))
+		}
+	}
+	if len(record.Networks) == 0 {
+		return
+	}
+	localmetrics.UpdateNetAttachDefNamespaceMetrics(record.Namespace, val)
+	for nadKey, attachments := range record.Networks {
+		nadNamespace, nadName, _ := cache.SplitMetaNamespaceKey(nadKey)
+		localmetrics.UpdateNetAttachDefUsageMetrics(nadNamespace, nadName, val, val*attachments)
+	}
+}
+
 func (c *Controller) parsePodNetworkAnnotation(podNetworks, defaultNamespace string) ([]*types.NetworkSelectionElement, error) {
 	var networks []*types.NetworkSelectionElement
 
@@ -0,0 +1,779 @@
+// Copyright (c) 2022 Network Plumbing Working Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	api_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/k8snetworkplumbingwg/net-attach-def-admission-controller/pkg/exemption"
+	"github.com/k8snetworkplumbingwg/net-attach-def-admission-controller/pkg/localmetrics"
+	"github.com/k8snetworkplumbingwg/net-attach-def-admission-controller/pkg/webhook"
+	networkv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	nadfake "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/client/clientset/versioned/fake"
+	netattachdefInformers "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/client/informers/externalversions/k8s.cni.cncf.io/v1"
+)
+
+func newTestNad(namespace, name, cniType string) *networkv1.NetworkAttachmentDefinition {
+	return &networkv1.NetworkAttachmentDefinition{
+		ObjectMeta: meta_v1.ObjectMeta{Namespace: namespace, Name: name},
+		Spec: networkv1.NetworkAttachmentDefinitionSpec{
+			Config: fmt.Sprintf(`{"cniVersion": "0.3.1", "name": "%s", "type": "%s"}`, name, cniType),
+		},
+	}
+}
+
+func newTestPod(namespace, name, networks string) *api_v1.Pod {
+	return &api_v1.Pod{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Namespace:   namespace,
+			Name:        name,
+			Annotations: map[string]string{nadPodAnnotation: networks},
+		},
+		Status: api_v1.PodStatus{Phase: api_v1.PodRunning},
+	}
+}
+
+func instances(networks string) float64 {
+	return testutil.ToFloat64(localmetrics.NetAttachDefInstanceCounter.WithLabelValues(networks))
+}
+
+func nadUsage(namespace, name string) (float64, float64) {
+	return testutil.ToFloat64(localmetrics.NetAttachDefPodCounter.WithLabelValues(namespace, name)),
+		testutil.ToFloat64(localmetrics.NetAttachDefAttachmentCounter.WithLabelValues(namespace, name))
+}
+
+var _ = Describe("Controller", func() {
+	var (
+		client    *fake.Clientset
+		nadClient *nadfake.Clientset
+		c         *Controller
+		recorder  *record.FakeRecorder
+		opts      Options
+		stopCh    chan struct{}
+	)
+
+	BeforeEach(func() {
+		opts = Options{Workers: 8}
+		recorder = record.NewFakeRecorder(100)
+		localmetrics.NetAttachDefInstanceCounter.Reset()
+		client = fake.NewSimpleClientset()
+		// objects passed to NewSimpleClientset end up under a guessed resource name
+		// the typed fake client does not use, create them through the client instead
+		nadClient = nadfake.NewSimpleClientset()
+		for _, nad := range []*networkv1.NetworkAttachmentDefinition{
+			newTestNad("default", "sriov-net", "sriov"),
+			newTestNad("default", "macvlan-net", "macvlan"),
+		} {
+			_, err := nadClient.K8sCniCncfIoV1().NetworkAttachmentDefinitions(nad.Namespace).Create(context.TODO(), nad, meta_v1.CreateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+		}
+	})
+
+	JustBeforeEach(func() {
+		podInformer := informers.NewSharedInformerFactory(client, 0).Core().V1().Pods().Informer()
+		if opts.IgnoreNamespaces != "" && opts.PodCounterReady == nil {
+			// the fake client does not filter by field, only watch the default namespace
+			podInformer = informers.NewSharedInformerFactoryWithOptions(client, 0,
+				informers.WithNamespace("default")).Core().V1().Pods().Informer()
+		}
+		nadInformer := netattachdefInformers.NewNetworkAttachmentDefinitionInformer(nadClient, api_v1.NamespaceAll, 0, cache.Indexers{})
+		c = newResourceController(client, nadClient, podInformer, nadInformer, recorder, opts)
+		if opts.TrackStuckPods {
+			factory := informers.NewSharedInformerFactory(client, 0)
+			c.EnableStuckPodTracking(factory.Core().V1().Pods().Informer(), factory.Core().V1().Events().Informer())
+		}
+		for _, ns := range strings.Split(opts.IgnoreNamespaces, ",") {
+			if ns != "" {
+				c.TrackIgnoredUsage(informers.NewSharedInformerFactoryWithOptions(client, 0,
+					informers.WithNamespace(ns)).Core().V1().Pods().Informer())
+			}
+		}
+		if opts.PodCounterReady != nil {
+			Expect(c.EnablePodCounting(strings.Split(opts.IgnoreNamespaces, ","), opts.PodCounterReady)).To(Succeed())
+		}
+		stopCh = make(chan struct{})
+		go c.Run(stopCh)
+		Eventually(c.HasSynced).Should(BeTrue())
+	})
+
+	AfterEach(func() {
+		close(stopCh)
+	})
+
+	Context("with many concurrent pod events", func() {
+		It("should keep metrics and store consistent", func() {
+			const podCount = 100
+			var wg sync.WaitGroup
+			for i := 0; i < podCount; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer GinkgoRecover()
+					defer wg.Done()
+					networks := "sriov-net"
+					if i%2 == 1 {
+						networks = "sriov-net,macvlan-net"
+					}
+					_, err := client.CoreV1().Pods("default").Create(context.TODO(),
+						newTestPod("default", fmt.Sprintf("pod-%d", i), networks), meta_v1.CreateOptions{})
+					Expect(err).NotTo(HaveOccurred())
+				}(i)
+			}
+			wg.Wait()
+
+			Eventually(func() float64 { return instances("any") }).Should(Equal(float64(podCount)))
+			Eventually(func() float64 { return instances("sriov") }).Should(Equal(float64(podCount)))
+			Eventually(func() float64 { return instances("macvlan") }).Should(Equal(float64(podCount / 2)))
+			Eventually(func() float64 { return instances("macvlan,sriov") }).Should(Equal(float64(podCount / 2)))
+			Eventually(c.store.Len).Should(Equal(podCount))
+			Expect(testutil.ToFloat64(localmetrics.NetAttachDefNamespaceInstanceCounter.WithLabelValues("default"))).To(Equal(float64(podCount)))
+			pods, attachments := nadUsage("default", "macvlan-net")
+			Expect(pods).To(Equal(float64(podCount / 2)))
+			Expect(attachments).To(Equal(float64(podCount / 2)))
+
+			for i := 0; i < podCount; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer GinkgoRecover()
+					defer wg.Done()
+					err := client.CoreV1().Pods("default").Delete(context.TODO(),
+						fmt.Sprintf("pod-%d", i), meta_v1.DeleteOptions{})
+					Expect(err).NotTo(HaveOccurred())
+				}(i)
+			}
+			wg.Wait()
+
+			Eventually(func() float64 { return instances("any") }).Should(BeZero())
+			Eventually(func() float64 { return instances("sriov") }).Should(BeZero())
+			Eventually(func() float64 { return instances("macvlan,sriov") }).Should(BeZero())
+			Eventually(c.store.Len).Should(BeZero())
+			Expect(testutil.CollectAndCount(localmetrics.NetAttachDefNamespaceInstanceCounter)).To(BeZero())
+			Expect(testutil.CollectAndCount(localmetrics.NetAttachDefPodCounter)).To(BeZero())
+		})
+	})
+
+	Context("with a pod attaching the same network twice", func() {
+		It("should count the pod once and both attachments", func() {
+			_, err := client.CoreV1().Pods("default").Create(context.TODO(),
+				newTestPod("default", "pod-dup", "macvlan-net,macvlan-net@net2,sriov-net"), meta_v1.CreateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() float64 { pods, _ := nadUsage("default", "macvlan-net"); return pods }).Should(Equal(float64(1)))
+			_, attachments := nadUsage("default", "macvlan-net")
+			Expect(attachments).To(Equal(float64(2)))
+			pods, attachments := nadUsage("default", "sriov-net")
+			Expect(pods).To(Equal(float64(1)))
+			Expect(attachments).To(Equal(float64(1)))
+
+			Expect(client.CoreV1().Pods("default").Delete(context.TODO(), "pod-dup", meta_v1.DeleteOptions{})).To(Succeed())
+			Eventually(c.store.Len).Should(BeZero())
+		})
+	})
+
+	Context("with pods scheduled on nodes", func() {
+		It("should count them per node and decrement the node they were counted on", func() {
+			nodeInstances := func(node, tp string) func() float64 {
+				return func() float64 {
+					return testutil.ToFloat64(localmetrics.NetAttachDefNodeInstanceCounter.WithLabelValues(node, tp))
+				}
+			}
+			pod := newTestPod("default", "pod-n", "sriov-net,macvlan-net")
+			pod.Spec.NodeName = "node-1"
+			_, err := client.CoreV1().Pods("default").Create(context.TODO(), pod, meta_v1.CreateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(nodeInstances("node-1", "sriov")).Should(Equal(float64(1)))
+			Eventually(nodeInstances("node-1", "macvlan")).Should(Equal(float64(1)))
+			Eventually(nodeInstances("node-1", "any")).Should(Equal(float64(1)))
+
+			// same pod key coming back on another node, e.g. a StatefulSet pod
+			pod.Spec.NodeName = "node-2"
+			pod.ResourceVersion = "2"
+			_, err = client.CoreV1().Pods("default").Update(context.TODO(), pod, meta_v1.UpdateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(nodeInstances("node-2", "sriov")).Should(Equal(float64(1)))
+			Eventually(nodeInstances("node-1", "sriov")).Should(BeZero())
+			Eventually(nodeInstances("node-1", "any")).Should(BeZero())
+
+			Expect(client.CoreV1().Pods("default").Delete(context.TODO(), "pod-n", meta_v1.DeleteOptions{})).To(Succeed())
+			Eventually(nodeInstances("node-2", "any")).Should(BeZero())
+			Eventually(c.store.Len).Should(BeZero())
+		})
+	})
+
+	Context("when a net-attach-def changes its type", func() {
+		It("should recompute metrics of the referencing pods", func() {
+			_, err := client.CoreV1().Pods("default").Create(context.TODO(),
+				newTestPod("default", "pod-a", "macvlan-net"), meta_v1.CreateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() float64 { return instances("macvlan") }).Should(Equal(float64(1)))
+
+			_, err = nadClient.K8sCniCncfIoV1().NetworkAttachmentDefinitions("default").Update(context.TODO(),
+				newTestNad("default", "macvlan-net", "sriov"), meta_v1.UpdateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() float64 { return instances("macvlan") }).Should(BeZero())
+			Eventually(func() float64 { return instances("sriov") }).Should(Equal(float64(1)))
+
+			err = nadClient.K8sCniCncfIoV1().NetworkAttachmentDefinitions("default").Delete(context.TODO(),
+				"macvlan-net", meta_v1.DeleteOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() float64 { return instances("sriov") }).Should(BeZero())
+			Eventually(func() float64 { return instances("any") }).Should(BeZero())
+
+			Expect(client.CoreV1().Pods("default").Delete(context.TODO(), "pod-a", meta_v1.DeleteOptions{})).To(Succeed())
+			Eventually(c.store.Len).Should(BeZero())
+		})
+	})
+
+	DescribeTable("Network config types",
+		func(config string, expected []string) {
+			nad := &networkv1.NetworkAttachmentDefinition{
+				Spec: networkv1.NetworkAttachmentDefinitionSpec{Config: config},
+			}
+			Expect(c.getConfigTypes(nad)).To(ConsistOf(expected))
+		},
+		Entry("single config", `{"cniVersion": "0.3.1", "name": "net", "type": "macvlan"}`, []string{"macvlan"}),
+		Entry("config list", `{"cniVersion": "0.3.1", "name": "net", "plugins": [{"type": "ovs"}, {"type": "tuning"}]}`,
+			[]string{"ovs", "tuning"}),
+		Entry("thin multus wrapper",
+			`{"cniVersion": "0.3.1", "name": "net", "type": "multus", "delegates": [
+				{"cniVersion": "0.3.1", "name": "d1", "type": "host-device"},
+				{"cniVersion": "0.3.1", "name": "d2", "plugins": [{"type": "macvlan"}]}]}`,
+			[]string{"host-device", "macvlan"}),
+		Entry("meta plugin delegate", `{"cniVersion": "0.3.1", "name": "net", "type": "flannel", "delegate": {"type": "bridge"}}`,
+			[]string{"bridge"}),
+		Entry("delegate without type", `{"cniVersion": "0.3.1", "name": "net", "type": "flannel", "delegate": {"isDefaultGateway": true}}`,
+			[]string{"flannel"}),
+	)
+
+	Context("with additional enabled instance types", func() {
+		It("should report whether they are in use", func() {
+			localmetrics.InitMetrics([]string{"macvlan", " host-device"})
+			enabled := func(tp string) func() float64 {
+				return func() float64 {
+					return testutil.ToFloat64(localmetrics.NetAttachDefEnabledInstanceUp.WithLabelValues(tp))
+				}
+			}
+			Expect(enabled("host-device")()).To(BeZero())
+
+			_, err := client.CoreV1().Pods("default").Create(context.TODO(),
+				newTestPod("default", "pod-e", "macvlan-net"), meta_v1.CreateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(enabled("macvlan")).Should(Equal(float64(1)))
+			Expect(enabled("host-device")()).To(BeZero())
+
+			Expect(client.CoreV1().Pods("default").Delete(context.TODO(), "pod-e", meta_v1.DeleteOptions{})).To(Succeed())
+			Eventually(enabled("macvlan")).Should(BeZero())
+		})
+	})
+
+	Context("with pods attached to a net-attach-def", func() {
+		var counters chan PodCounter
+
+		BeforeEach(func() {
+			counters = make(chan PodCounter, 1)
+			opts.PodCounterReady = func(counter PodCounter) { counters <- counter }
+		})
+
+		It("should count the non-terminal ones for the quotas of the webhook", func() {
+			var count PodCounter
+			Eventually(counters).Should(Receive(&count))
+			for i, phase := range []api_v1.PodPhase{api_v1.PodPending, api_v1.PodRunning, api_v1.PodSucceeded, api_v1.PodFailed} {
+				pod := newTestPod("default", fmt.Sprintf("pod-q%d", i), "macvlan-net,macvlan-net")
+				pod.Status.Phase = phase
+				_, err := client.CoreV1().Pods("default").Create(context.TODO(), pod, meta_v1.CreateOptions{})
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Eventually(func() int { return count("default/macvlan-net") }).Should(Equal(2))
+			Expect(count("default/sriov-net")).To(BeZero())
+
+			By("only reporting the running ones in the metrics")
+			Eventually(func() float64 { pods, _ := nadUsage("default", "macvlan-net"); return pods }).Should(Equal(1.0))
+			Consistently(func() float64 { pods, _ := nadUsage("default", "macvlan-net"); return pods }, "200ms").Should(Equal(1.0))
+
+			Expect(client.CoreV1().Pods("default").Delete(context.TODO(), "pod-q0", meta_v1.DeleteOptions{})).To(Succeed())
+			Eventually(func() int { return count("default/macvlan-net") }).Should(Equal(1))
+		})
+
+		Context("in ignored namespaces", func() {
+			BeforeEach(func() {
+				opts.IgnoreNamespaces = "kube-system"
+			})
+
+			It("should count them without reporting them", func() {
+				var count PodCounter
+				Eventually(counters).Should(Receive(&count))
+				_, err := client.CoreV1().Pods("kube-system").Create(context.TODO(),
+					newTestPod("kube-system", "pod-i", "default/macvlan-net"), meta_v1.CreateOptions{})
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(func() int { return count("default/macvlan-net") }).Should(Equal(1))
+				Consistently(c.store.Len, "200ms").Should(BeZero())
+			})
+		})
+	})
+
+	Context("with a pod referencing a missing net-attach-def", func() {
+		It("should report it until the net-attach-def is created", func() {
+			missing := func() float64 {
+				return testutil.ToFloat64(localmetrics.NetAttachDefMissingReferenceCounter.WithLabelValues("default"))
+			}
+			_, err := client.CoreV1().Pods("default").Create(context.TODO(),
+				newTestPod("default", "pod-m", "macvlan-net,other/missing-net"), meta_v1.CreateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(missing).Should(Equal(float64(1)))
+			Expect(c.missingReferences()).To(Equal([]missingReference{{Pod: "default/pod-m", Missing: []string{"other/missing-net"}}}))
+
+			w := httptest.NewRecorder()
+			c.missingReferencesHandler(w, httptest.NewRequest("GET", MissingReferencesPath, nil))
+			Expect(w.Body.String()).To(Equal(`[{"pod":"default/pod-m","missing":["other/missing-net"]}]`))
+
+			Expect(recorder.Events).To(Receive(ContainSubstring("MissingNetworkAttachmentDefinition")))
+
+			_, err = nadClient.K8sCniCncfIoV1().NetworkAttachmentDefinitions("other").Create(context.TODO(),
+				newTestNad("other", "missing-net", "bridge"), meta_v1.CreateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(missing).Should(BeZero())
+			Eventually(func() float64 { return instances("bridge,macvlan") }).Should(Equal(float64(1)))
+			Expect(c.missingReferences()).To(BeEmpty())
+
+			Expect(client.CoreV1().Pods("default").Delete(context.TODO(), "pod-m", meta_v1.DeleteOptions{})).To(Succeed())
+			Eventually(c.store.Len).Should(BeZero())
+		})
+	})
+
+	Context("with pods reporting their network status", func() {
+		It("should compare requested and attached networks", func() {
+			gauge := func(vec *prometheus.GaugeVec, labels ...string) func() float64 {
+				return func() float64 { return testutil.ToFloat64(vec.WithLabelValues(labels...)) }
+			}
+			pod := newTestPod("default", "pod-s", "macvlan-net,sriov-net")
+			pod.Annotations[networkv1.NetworkStatusAnnot] = `[
+				{"name": "cbr0", "interface": "eth0", "ips": ["10.244.1.5"], "default": true},
+				{"name": "default/macvlan-net", "interface": "net1", "ips": ["192.168.1.200", "fd00::c8"]}]`
+			_, err := client.CoreV1().Pods("default").Create(context.TODO(), pod, meta_v1.CreateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(gauge(localmetrics.NetAttachDefNotAttachedCounter, "default", "sriov-net")).Should(Equal(float64(1)))
+			Expect(gauge(localmetrics.NetAttachDefNotAttachedCounter, "default", "macvlan-net")()).To(BeZero())
+			Expect(gauge(localmetrics.NetAttachDefPodInterfacesCounter, "2")()).To(Equal(float64(1)))
+			Expect(gauge(localmetrics.NetAttachDefIPsInUseCounter, "default", "macvlan-net")()).To(Equal(float64(2)))
+
+			// older multus releases name the network without namespace
+			pod.Annotations[networkv1.NetworkStatusAnnot] = `[
+				{"name": "cbr0", "interface": "eth0", "ips": ["10.244.1.5"], "default": true},
+				{"name": "default/macvlan-net", "interface": "net1", "ips": ["192.168.1.200", "fd00::c8"]},
+				{"name": "sriov-net", "interface": "net2", "ips": ["10.56.217.2"]}]`
+			pod.ResourceVersion = "2"
+			_, err = client.CoreV1().Pods("default").Update(context.TODO(), pod, meta_v1.UpdateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(gauge(localmetrics.NetAttachDefNotAttachedCounter, "default", "sriov-net")).Should(BeZero())
+			Eventually(gauge(localmetrics.NetAttachDefPodInterfacesCounter, "3")).Should(Equal(float64(1)))
+			Expect(gauge(localmetrics.NetAttachDefPodInterfacesCounter, "2")()).To(BeZero())
+			Expect(gauge(localmetrics.NetAttachDefIPsInUseCounter, "default", "sriov-net")()).To(Equal(float64(1)))
+
+			Expect(client.CoreV1().Pods("default").Delete(context.TODO(), "pod-s", meta_v1.DeleteOptions{})).To(Succeed())
+			Eventually(gauge(localmetrics.NetAttachDefPodInterfacesCounter, "3")).Should(BeZero())
+			Expect(gauge(localmetrics.NetAttachDefIPsInUseCounter, "default", "macvlan-net")()).To(BeZero())
+		})
+	})
+
+	Context("with net-attach-defs having IPAM ranges", func() {
+		It("should export range utilization and duplicate addresses", func() {
+			gauge := func(vec *prometheus.GaugeVec) func() float64 {
+				return func() float64 { return testutil.ToFloat64(vec.WithLabelValues("default", "ipam-net")) }
+			}
+			nad := newTestNad("default", "ipam-net", "macvlan")
+			nad.Spec.Config = `{"cniVersion": "0.3.1", "name": "ipam-net", "type": "macvlan", "ipam": {
+				"type": "host-local", "subnet": "192.168.1.0/24", "rangeStart": "192.168.1.200", "rangeEnd": "192.168.1.209"}}`
+			_, err := nadClient.K8sCniCncfIoV1().NetworkAttachmentDefinitions("default").Create(context.TODO(), nad, meta_v1.CreateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(gauge(localmetrics.NetAttachDefIPRangeSize)).Should(Equal(float64(10)))
+
+			for i, ip := range []string{"192.168.1.200", "192.168.1.200", "192.168.1.201"} {
+				pod := newTestPod("default", fmt.Sprintf("pod-ip-%d", i), "ipam-net")
+				pod.Annotations[networkv1.NetworkStatusAnnot] = fmt.Sprintf(`[{"name": "default/ipam-net", "ips": ["%s"]}]`, ip)
+				_, err := client.CoreV1().Pods("default").Create(context.TODO(), pod, meta_v1.CreateOptions{})
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Eventually(gauge(localmetrics.NetAttachDefDuplicateIPs)).Should(Equal(float64(1)))
+			Eventually(gauge(localmetrics.NetAttachDefIPRangeInUse)).Should(Equal(float64(2)))
+			Expect(gauge(localmetrics.NetAttachDefIPRangeUtilization)()).To(BeNumerically("~", 0.2))
+			Expect(recorder.Events).To(Receive(ContainSubstring("DuplicateIP")))
+
+			By("not reporting the duplicate again on pod updates")
+			pod, err := client.CoreV1().Pods("default").Get(context.TODO(), "pod-ip-1", meta_v1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			pod.Labels = map[string]string{"updated": "true"}
+			// the fake clientset does not bump resource versions, the controller skips updates without
+			pod.ResourceVersion = "2"
+			_, err = client.CoreV1().Pods("default").Update(context.TODO(), pod, meta_v1.UpdateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Consistently(recorder.Events, "300ms").ShouldNot(Receive(ContainSubstring("DuplicateIP")))
+
+			Expect(client.CoreV1().Pods("default").Delete(context.TODO(), "pod-ip-1", meta_v1.DeleteOptions{})).To(Succeed())
+			Eventually(gauge(localmetrics.NetAttachDefDuplicateIPs)).Should(BeZero())
+			Expect(gauge(localmetrics.NetAttachDefIPRangeInUse)()).To(Equal(float64(2)))
+
+			for _, name := range []string{"pod-ip-0", "pod-ip-2"} {
+				Expect(client.CoreV1().Pods("default").Delete(context.TODO(), name, meta_v1.DeleteOptions{})).To(Succeed())
+			}
+			Eventually(gauge(localmetrics.NetAttachDefIPRangeInUse)).Should(BeZero())
+		})
+	})
+
+	DescribeTable("IPAM range size",
+		func(config string, expected int64) {
+			ranges, err := parseIPRanges([]byte(config))
+			Expect(err).NotTo(HaveOccurred())
+			var size int64
+			for _, r := range ranges {
+				size += r.size().Int64()
+			}
+			Expect(size).To(Equal(expected))
+		},
+		Entry("host-local subnet without gateway", `{"ipam": {"type": "host-local", "subnet": "192.168.1.0/24"}}`, int64(254)),
+		Entry("host-local subnet with gateway", `{"ipam": {"type": "host-local", "subnet": "192.168.1.0/24", "gateway": "192.168.1.1"}}`, int64(253)),
+		Entry("host-local range", `{"ipam": {"type": "host-local", "subnet": "192.168.1.0/24",
+			"rangeStart": "192.168.1.200", "rangeEnd": "192.168.1.216", "gateway": "192.168.1.1"}}`, int64(17)),
+		Entry("host-local ranges in a config list", `{"plugins": [{"type": "bridge", "ipam": {"type": "host-local", "ranges": [
+			[{"subnet": "10.10.0.0/30"}], [{"subnet": "fd00::/120"}]]}}, {"type": "tuning"}]}`, int64(2+255)),
+		Entry("whereabouts range with start address", `{"ipam": {"type": "whereabouts", "range": "192.168.2.225/28"}}`, int64(14)),
+		Entry("whereabouts range with excludes", `{"ipam": {"type": "whereabouts", "range": "192.168.2.225/28",
+			"exclude": ["192.168.2.229/30", "10.0.0.0/8"]}}`, int64(10)),
+		Entry("whereabouts overlapping excludes", `{"ipam": {"type": "whereabouts", "range": "192.168.2.0/28",
+			"exclude": ["192.168.2.0/29", "192.168.2.4/30", "192.168.2.8/32"]}}`, int64(14-7-1)),
+		Entry("whereabouts gateway in an exclude", `{"ipam": {"type": "whereabouts", "range": "192.168.2.0/28",
+			"gateway": "192.168.2.1", "exclude": ["192.168.2.0/30"]}}`, int64(14-3)),
+		Entry("whereabouts gateway out of the excludes", `{"ipam": {"type": "whereabouts", "range": "192.168.2.0/28",
+			"gateway": "192.168.2.14", "exclude": ["192.168.2.0/30"]}}`, int64(14-3-1)),
+		Entry("whereabouts range start and end", `{"ipam": {"type": "whereabouts", "range": "192.168.2.0/24",
+			"range_start": "192.168.2.10", "range_end": "192.168.2.19"}}`, int64(10)),
+		Entry("whereabouts ipRanges", `{"ipam": {"type": "whereabouts", "ipRanges": [{"range": "192.168.10.0/29"}, {"range": "fd10::/125"}]}}`,
+			int64(6+7)),
+		Entry("no ranges", `{"ipam": {"type": "dhcp"}}`, int64(0)),
+	)
+
+	Context("with unused net-attach-defs", func() {
+		BeforeEach(func() {
+			opts.UnusedGracePeriod = 200 * time.Millisecond
+			opts.AnnotateUnused = true
+		})
+
+		It("should report and annotate them until a pod uses them", func() {
+			unused := func(name string) func() float64 {
+				return func() float64 {
+					return testutil.ToFloat64(localmetrics.NetAttachDefUnused.WithLabelValues("default", name))
+				}
+			}
+			nadAnnotations := func(name string) func() map[string]string {
+				return func() map[string]string {
+					nad, err := nadClient.K8sCniCncfIoV1().NetworkAttachmentDefinitions("default").Get(context.TODO(), name, meta_v1.GetOptions{})
+					Expect(err).NotTo(HaveOccurred())
+					return nad.GetAnnotations()
+				}
+			}
+			Eventually(unused("macvlan-net")).Should(Equal(float64(1)))
+			Eventually(unused("sriov-net")).Should(Equal(float64(1)))
+			Eventually(nadAnnotations("macvlan-net")).Should(HaveKey(unusedSinceAnnotation))
+			Expect(recorder.Events).To(Receive(ContainSubstring("Unused")))
+
+			_, err := client.CoreV1().Pods("default").Create(context.TODO(),
+				newTestPod("default", "pod-u", "macvlan-net"), meta_v1.CreateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(unused("macvlan-net")).Should(BeZero())
+			Eventually(nadAnnotations("macvlan-net")).ShouldNot(HaveKey(unusedSinceAnnotation))
+			Consistently(unused("macvlan-net"), 500*time.Millisecond).Should(BeZero())
+			Expect(unused("sriov-net")()).To(Equal(float64(1)))
+
+			Expect(client.CoreV1().Pods("default").Delete(context.TODO(), "pod-u", meta_v1.DeleteOptions{})).To(Succeed())
+			Eventually(unused("macvlan-net")).Should(Equal(float64(1)))
+		})
+	})
+
+	Context("with unused net-attach-defs and ignored namespaces", func() {
+		BeforeEach(func() {
+			opts.UnusedGracePeriod = 200 * time.Millisecond
+			opts.IgnoreNamespaces = "ignored"
+			localmetrics.NetAttachDefUnused.Reset()
+		})
+
+		It("should count the pods of ignored namespaces as users", func() {
+			_, err := client.CoreV1().Pods("ignored").Create(context.TODO(),
+				newTestPod("ignored", "pod-i", "default/macvlan-net"), meta_v1.CreateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			unused := func(name string) func() float64 {
+				return func() float64 {
+					return testutil.ToFloat64(localmetrics.NetAttachDefUnused.WithLabelValues("default", name))
+				}
+			}
+			Eventually(unused("sriov-net")).Should(Equal(float64(1)))
+			Consistently(unused("macvlan-net"), 500*time.Millisecond).Should(BeZero())
+			_, exists, _ := c.informer.GetIndexer().GetByKey("ignored/pod-i")
+			Expect(exists).To(BeFalse())
+
+			Expect(client.CoreV1().Pods("ignored").Delete(context.TODO(), "pod-i", meta_v1.DeleteOptions{})).To(Succeed())
+			Eventually(unused("macvlan-net")).Should(Equal(float64(1)))
+		})
+	})
+
+	Context("with pods stuck attaching networks", func() {
+		failures := func(name string) float64 {
+			return testutil.ToFloat64(localmetrics.NetAttachDefAttachmentFailures.WithLabelValues("stuck", name))
+		}
+		sandboxFailure := func(name, message string, count int32) *api_v1.Event {
+			return &api_v1.Event{
+				ObjectMeta:     meta_v1.ObjectMeta{Namespace: "stuck", Name: name, UID: "uid-" + k8stypes.UID(name)},
+				InvolvedObject: api_v1.ObjectReference{Kind: "Pod", Namespace: "stuck", Name: "pending-pod"},
+				Reason:         sandboxFailureReason,
+				Message:        message,
+				Count:          count,
+			}
+		}
+
+		BeforeEach(func() {
+			opts.TrackStuckPods = true
+			localmetrics.NetAttachDefAttachmentFailures.Reset()
+			localmetrics.NetAttachDefStuckPodAge.Reset()
+		})
+
+		It("should count failures of the mentioned network and export the stuck pod age", func() {
+			pod := newTestPod("stuck", "pending-pod", "first-net,second-net")
+			pod.Status.Phase = api_v1.PodPending
+			pod.CreationTimestamp = meta_v1.NewTime(time.Now().Add(-time.Minute))
+			_, err := client.CoreV1().Pods("stuck").Create(context.TODO(), pod, meta_v1.CreateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() bool {
+				_, exists, _ := c.pendingInformer.GetIndexer().GetByKey("stuck/pending-pod")
+				return exists
+			}).Should(BeTrue())
+
+			event := sandboxFailure("failure", `error adding container to network "second-net": failed to set up pod`, 1)
+			_, err = client.CoreV1().Events("stuck").Create(context.TODO(), event, meta_v1.CreateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() float64 { return failures("second-net") }).Should(Equal(1.0))
+			Expect(failures("first-net")).To(Equal(0.0))
+
+			event.Count = 3
+			_, err = client.CoreV1().Events("stuck").Update(context.TODO(), event, meta_v1.UpdateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() float64 { return failures("second-net") }).Should(Equal(3.0))
+
+			c.syncStuckPods()
+			age := testutil.ToFloat64(localmetrics.NetAttachDefStuckPodAge.WithLabelValues("stuck", "second-net"))
+			Expect(age).To(BeNumerically(">=", 60))
+
+			Expect(client.CoreV1().Pods("stuck").Delete(context.TODO(), "pending-pod", meta_v1.DeleteOptions{})).To(Succeed())
+			Eventually(func() bool {
+				_, exists, _ := c.pendingInformer.GetIndexer().GetByKey("stuck/pending-pod")
+				return exists
+			}).Should(BeFalse())
+			c.syncStuckPods()
+			Expect(testutil.CollectAndCount(localmetrics.NetAttachDefStuckPodAge)).To(Equal(0))
+		})
+
+		It("should count failures seen before their pod", func() {
+			event := sandboxFailure("early-failure", `error adding container to network "first-net": failed to set up pod`, 2)
+			_, err := client.CoreV1().Events("stuck").Create(context.TODO(), event, meta_v1.CreateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() bool {
+				_, exists, _ := c.eventInformer.GetIndexer().GetByKey("stuck/early-failure")
+				return exists
+			}).Should(BeTrue())
+			Expect(failures("first-net")).To(Equal(0.0))
+
+			pod := newTestPod("stuck", "pending-pod", "first-net,second-net")
+			pod.Status.Phase = api_v1.PodPending
+			_, err = client.CoreV1().Pods("stuck").Create(context.TODO(), pod, meta_v1.CreateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() float64 { return failures("first-net") }).Should(Equal(2.0))
+			Expect(failures("second-net")).To(Equal(0.0))
+		})
+
+		Context("with failures before the controller started", func() {
+			var event *api_v1.Event
+
+			BeforeEach(func() {
+				pod := newTestPod("stuck", "pending-pod", "first-net")
+				pod.Status.Phase = api_v1.PodPending
+				_, err := client.CoreV1().Pods("stuck").Create(context.TODO(), pod, meta_v1.CreateOptions{})
+				Expect(err).NotTo(HaveOccurred())
+				event = sandboxFailure("past-failure", `error adding container to network "first-net": failed to set up pod`, 4)
+				event.LastTimestamp = meta_v1.NewTime(time.Now().Add(-time.Hour))
+				_, err = client.CoreV1().Events("stuck").Create(context.TODO(), event, meta_v1.CreateOptions{})
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("should only count the failures seen since", func() {
+				Consistently(func() float64 { return failures("first-net") }, "200ms").Should(Equal(0.0))
+
+				event.Count = 5
+				event.LastTimestamp = meta_v1.Now()
+				_, err := client.CoreV1().Events("stuck").Update(context.TODO(), event, meta_v1.UpdateOptions{})
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(func() float64 { return failures("first-net") }).Should(Equal(1.0))
+			})
+		})
+
+		It("should blame all networks of the pod for multus failures not naming one", func() {
+			pod := newTestPod("stuck", "pending-pod", "first-net,second-net")
+			pod.Status.Phase = api_v1.PodPending
+			_, err := client.CoreV1().Pods("stuck").Create(context.TODO(), pod, meta_v1.CreateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() bool {
+				_, exists, _ := c.pendingInformer.GetIndexer().GetByKey("stuck/pending-pod")
+				return exists
+			}).Should(BeTrue())
+
+			event := sandboxFailure("multus-failure", "plugin type=\"multus\" failed (add): timed out", 2)
+			_, err = client.CoreV1().Events("stuck").Create(context.TODO(), event, meta_v1.CreateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() float64 { return failures("first-net") }).Should(Equal(2.0))
+			Eventually(func() float64 { return failures("second-net") }).Should(Equal(2.0))
+		})
+	})
+
+	Context("when auditing net-attach-defs", func() {
+		violations := func() float64 {
+			return testutil.ToFloat64(localmetrics.NetAttachDefAuditViolations.WithLabelValues(webhook.RuleConfigNotJSON))
+		}
+		annotation := func() string {
+			nad, err := nadClient.K8sCniCncfIoV1().NetworkAttachmentDefinitions("default").Get(context.TODO(), "broken-net", meta_v1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			return nad.Annotations[violationsAnnotation]
+		}
+
+		BeforeEach(func() {
+			opts.AuditInterval = 100 * time.Millisecond
+			localmetrics.NetAttachDefAuditViolations.Reset()
+			nad := newTestNad("default", "broken-net", "macvlan")
+			nad.Spec.Config = "not json"
+			_, err := nadClient.K8sCniCncfIoV1().NetworkAttachmentDefinitions("default").Create(context.TODO(), nad, meta_v1.CreateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should report violations of existing net-attach-defs until fixed", func() {
+			Eventually(annotation).Should(ContainSubstring(`"rule":"` + webhook.RuleConfigNotJSON + `"`))
+			Eventually(violations).Should(Equal(1.0))
+			Eventually(recorder.Events).Should(Receive(ContainSubstring("PolicyViolation")))
+			Expect(testutil.CollectAndCount(localmetrics.NetAttachDefAuditViolations)).To(Equal(1))
+
+			nad, err := nadClient.K8sCniCncfIoV1().NetworkAttachmentDefinitions("default").Get(context.TODO(), "broken-net", meta_v1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			nad.Spec.Config = `{"cniVersion": "0.3.1", "name": "broken-net", "type": "macvlan"}`
+			_, err = nadClient.K8sCniCncfIoV1().NetworkAttachmentDefinitions("default").Update(context.TODO(), nad, meta_v1.UpdateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(annotation).Should(BeEmpty())
+			Eventually(func() int {
+				return testutil.CollectAndCount(localmetrics.NetAttachDefAuditViolations)
+			}).Should(Equal(0))
+		})
+
+		Context("with exemptions", func() {
+			BeforeEach(func() {
+				opts.Exemptions = exemption.New(exemption.Config{Namespaces: []string{"default"}}, nil)
+			})
+
+			It("should not report violations of exempt net-attach-defs", func() {
+				localmetrics.NetAttachDefExemptions.Reset()
+				localmetrics.NetAttachDefAuditLastRun.Set(0)
+				Eventually(func() float64 {
+					return testutil.ToFloat64(localmetrics.NetAttachDefAuditLastRun)
+				}).Should(BeNumerically(">", 0))
+				Consistently(annotation, "300ms").Should(BeEmpty())
+				Expect(testutil.CollectAndCount(localmetrics.NetAttachDefAuditViolations)).To(Equal(0))
+
+				By("neither logging nor counting the exemptions at every audit")
+				Expect(testutil.CollectAndCount(localmetrics.NetAttachDefExemptions)).To(Equal(0))
+			})
+		})
+	})
+
+	Context("when auditing running pods", func() {
+		BeforeEach(func() {
+			opts.AuditInterval = 100 * time.Millisecond
+			opts.AuditPods = true
+			localmetrics.NetAttachDefPodAuditViolations.Reset()
+		})
+
+		It("should report pods attaching networks of other namespaces", func() {
+			_, err := client.CoreV1().Pods("default").Create(context.TODO(), newTestPod("default", "local-pod", "sriov-net"), meta_v1.CreateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = client.CoreV1().Pods("default").Create(context.TODO(), newTestPod("default", "foreign-pod", "other/sriov-net"), meta_v1.CreateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+
+			Eventually(func() float64 {
+				return testutil.ToFloat64(localmetrics.NetAttachDefPodAuditViolations.WithLabelValues("default", webhook.RuleCrossNamespaceNetwork))
+			}).Should(Equal(1.0))
+			Eventually(recorder.Events).Should(Receive(ContainSubstring("PolicyViolation")))
+
+			Expect(client.CoreV1().Pods("default").Delete(context.TODO(), "foreign-pod", meta_v1.DeleteOptions{})).To(Succeed())
+			Eventually(func() int {
+				return testutil.CollectAndCount(localmetrics.NetAttachDefPodAuditViolations)
+			}).Should(Equal(0))
+		})
+	})
+})
+
+var _ = Describe("nadPodIndex", func() {
+	var index *nadPodIndex
+
+	BeforeEach(func() {
+		index = newNadPodIndex()
+	})
+
+	It("should map net-attach-defs to the pods referencing them", func() {
+		index.set("default/pod-a", []string{"default/net-1", "other/net-2"})
+		index.set("default/pod-b", []string{"default/net-1"})
+		Expect(index.podsFor("default/net-1")).To(ConsistOf("default/pod-a", "default/pod-b"))
+		Expect(index.podsFor("other/net-2")).To(ConsistOf("default/pod-a"))
+		Expect(index.podsFor("default/net-3")).To(BeEmpty())
+	})
+
+	It("should replace the references of a pod", func() {
+		index.set("default/pod-a", []string{"default/net-1"})
+		index.set("default/pod-a", []string{"default/net-2"})
+		Expect(index.podsFor("default/net-1")).To(BeEmpty())
+		Expect(index.podsFor("default/net-2")).To(ConsistOf("default/pod-a"))
+
+		index.set("default/pod-a", nil)
+		Expect(index.podsFor("default/net-2")).To(BeEmpty())
+	})
+
+	It("should drop removed pods", func() {
+		index.set("default/pod-a", []string{"default/net-1"})
+		index.set("default/pod-b", []string{"default/net-1"})
+		index.remove("default/pod-a")
+		Expect(index.podsFor("default/net-1")).To(ConsistOf("default/pod-b"))
+		index.remove("default/pod-b")
+		Expect(index.podsFor("default/net-1")).To(BeEmpty())
+		// removing an unknown pod is a no-op
+		index.remove("default/pod-c")
+	})
+})
@@ -0,0 +1,477 @@
+// Copyright (c) 2022 Network Plumbing Working Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/k8snetworkplumbingwg/net-attach-def-admission-controller/pkg/localmetrics"
+	networkv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	api_v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// ipRange is a range of allocatable addresses of an IPAM config
+type ipRange struct {
+	start    net.IP
+	end      net.IP
+	excludes []*net.IPNet
+}
+
+// ipamConfig holds the range fields of the host-local and whereabouts IPAM plugins
+type ipamConfig struct {
+	// host-local
+	Subnet     string `json:"subnet"`
+	RangeStart string `json:"rangeStart"`
+	RangeEnd   string `json:"rangeEnd"`
+	Gateway    string `json:"gateway"`
+	Ranges     [][]struct {
+		Subnet     string `json:"subnet"`
+		RangeStart string `json:"rangeStart"`
+		RangeEnd   string `json:"rangeEnd"`
+		Gateway    string `json:"gateway"`
+	} `json:"ranges"`
+	// whereabouts
+	Range                 string   `json:"range"`
+	WhereaboutsRangeStart string   `json:"range_start"`
+	WhereaboutsRangeEnd   string   `json:"range_end"`
+	Exclude               []string `json:"exclude"`
+	IPRanges              []struct {
+		Range      string   `json:"range"`
+		RangeStart string   `json:"range_start"`
+		RangeEnd   string   `json:"range_end"`
+		Exclude    []string `json:"exclude"`
+	} `json:"ipRanges"`
+}
+
+// parseIPRanges returns the address ranges of the IPAM sections of a network config or config list
+func parseIPRanges(config []byte) ([]ipRange, error) {
+	var conf struct {
+		IPAM    json.RawMessage `json:"ipam"`
+		Plugins []struct {
+			IPAM json.RawMessage `json:"ipam"`
+		} `json:"plugins"`
+	}
+	if err := json.Unmarshal(config, &conf); err != nil {
+		return nil, err
+	}
+
+	ipamSections := []json.RawMessage{conf.IPAM}
+	for _, plugin := range conf.Plugins {
+		ipamSections = append(ipamSections, plugin.IPAM)
+	}
+
+	var ranges []ipRange
+	for _, section := range ipamSections {
+		if len(section) == 0 {
+			continue
+		}
+		var ipam ipamConfig
+		if err := json.Unmarshal(section, &ipam); err != nil {
+			return nil, err
+		}
+		sectionRanges, err := ipam.ranges()
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, sectionRanges...)
+	}
+	return ranges, nil
+}
+
+func (ipam *ipamConfig) ranges() ([]ipRange, error) {
+	var ranges []ipRange
+	add := func(subnet, start, end, gateway string, excludes []string) error {
+		if subnet == "" {
+			return nil
+		}
+		r, err := newIPRange(subnet, start, end, excludes)
+		if err != nil {
+			return err
+		}
+		// neither host-local nor whereabouts hand out the gateway
+		if gw := net.ParseIP(gateway); gw != nil && r.contains(gw) {
+			r.excludes = append(r.excludes, singleIPNet(gw))
+		}
+		ranges = append(ranges, r)
+		return nil
+	}
+
+	if err := add(ipam.Subnet, ipam.RangeStart, ipam.RangeEnd, ipam.Gateway, nil); err != nil {
+		return nil, err
+	}
+	for _, set := range ipam.Ranges {
+		for _, r := range set {
+			if err := add(r.Subnet, r.RangeStart, r.RangeEnd, r.Gateway, nil); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := add(ipam.Range, ipam.WhereaboutsRangeStart, ipam.WhereaboutsRangeEnd, ipam.Gateway, ipam.Exclude); err != nil {
+		return nil, err
+	}
+	for _, r := range ipam.IPRanges {
+		if err := add(r.Range, r.RangeStart, r.RangeEnd, "", r.Exclude); err != nil {
+			return nil, err
+		}
+	}
+	return ranges, nil
+}
+
+// newIPRange returns the range of the subnet, without network and broadcast addresses,
+// narrowed to start and end when given. An address in the subnet (e.g. 192.168.2.225/28)
+// is used as start, as whereabouts does.
+func newIPRange(subnet, start, end string, excludes []string) (ipRange, error) {
+	ip, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return ipRange{}, fmt.Errorf("invalid subnet %q: %v", subnet, err)
+	}
+	r := ipRange{
+		start: nextIP(ipNet.IP),
+		end:   lastIP(ipNet),
+	}
+	if ip.To4() != nil {
+		r.end = prevIP(r.end) // broadcast
+	}
+	if !ip.Equal(ipNet.IP) && ipNet.Contains(ip) {
+		r.start = normalizeIP(ip)
+	}
+	if start != "" {
+		if r.start = normalizeIP(net.ParseIP(start)); r.start == nil || !ipNet.Contains(r.start) {
+			return ipRange{}, fmt.Errorf("invalid range start %q for subnet %q", start, subnet)
+		}
+	}
+	if end != "" {
+		if r.end = normalizeIP(net.ParseIP(end)); r.end == nil || !ipNet.Contains(r.end) {
+			return ipRange{}, fmt.Errorf("invalid range end %q for subnet %q", end, subnet)
+		}
+	}
+	for _, exclude := range excludes {
+		_, excludeNet, err := net.ParseCIDR(exclude)
+		if err != nil {
+			return ipRange{}, fmt.Errorf("invalid exclude %q: %v", exclude, err)
+		}
+		r.excludes = append(r.excludes, excludeNet)
+	}
+	return r, nil
+}
+
+// size returns the number of allocatable addresses of the range
+func (r ipRange) size() *big.Int {
+	size := new(big.Int).Sub(ipToInt(r.end), ipToInt(r.start))
+	size.Add(size, big.NewInt(1))
+	if size.Sign() <= 0 {
+		return big.NewInt(0)
+	}
+	for _, excluded := range r.excludedIntervals() {
+		count := new(big.Int).Sub(ipToInt(excluded[1]), ipToInt(excluded[0]))
+		size.Sub(size, count.Add(count, big.NewInt(1)))
+	}
+	if size.Sign() < 0 {
+		return big.NewInt(0)
+	}
+	return size
+}
+
+// excludedIntervals returns the first and last addresses of the excludes within the range,
+// sorted and merged so that addresses excluded several times, such as a gateway within an
+// exclude, are only counted once
+func (r ipRange) excludedIntervals() [][2]net.IP {
+	var intervals [][2]net.IP
+	for _, exclude := range r.excludes {
+		if len(normalizeIP(exclude.IP)) != len(r.start) {
+			continue
+		}
+		// only count the part of the exclude within the range
+		first, last := maxIP(normalizeIP(exclude.IP), r.start), minIP(lastIP(exclude), r.end)
+		if bytes.Compare(first, last) <= 0 {
+			intervals = append(intervals, [2]net.IP{first, last})
+		}
+	}
+	sort.Slice(intervals, func(i, j int) bool {
+		return bytes.Compare(intervals[i][0], intervals[j][0]) < 0
+	})
+
+	var merged [][2]net.IP
+	for _, interval := range intervals {
+		if n := len(merged); n > 0 && bytes.Compare(interval[0], nextIP(merged[n-1][1])) <= 0 {
+			merged[n-1][1] = maxIP(merged[n-1][1], interval[1])
+			continue
+		}
+		merged = append(merged, interval)
+	}
+	return merged
+}
+
+// contains tells whether the address is allocatable from the range
+func (r ipRange) contains(ip net.IP) bool {
+	ip = normalizeIP(ip)
+	if ip == nil || len(ip) != len(r.start) || bytes.Compare(ip, r.start) < 0 || bytes.Compare(ip, r.end) > 0 {
+		return false
+	}
+	for _, exclude := range r.excludes {
+		if exclude.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeIP returns 4 byte IPv4 and 16 byte IPv6 addresses so they compare bytewise
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip.To16()
+}
+
+func singleIPNet(ip net.IP) *net.IPNet {
+	ip = normalizeIP(ip)
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+}
+
+func ipToInt(ip net.IP) *big.Int {
+	return new(big.Int).SetBytes(normalizeIP(ip))
+}
+
+func intToIP(i *big.Int, length int) net.IP {
+	ip := make(net.IP, length)
+	b := i.Bytes()
+	if len(b) > length {
+		b = b[len(b)-length:]
+	}
+	copy(ip[length-len(b):], b)
+	return ip
+}
+
+func nextIP(ip net.IP) net.IP {
+	ip = normalizeIP(ip)
+	return intToIP(new(big.Int).Add(ipToInt(ip), big.NewInt(1)), len(ip))
+}
+
+func prevIP(ip net.IP) net.IP {
+	ip = normalizeIP(ip)
+	return intToIP(new(big.Int).Sub(ipToInt(ip), big.NewInt(1)), len(ip))
+}
+
+func lastIP(ipNet *net.IPNet) net.IP {
+	ip := normalizeIP(ipNet.IP)
+	last := make(net.IP, len(ip))
+	for i := range ip {
+		last[i] = ip[i] | ^ipNet.Mask[len(ipNet.Mask)-len(ip)+i]
+	}
+	return last
+}
+
+func minIP(a, b net.IP) net.IP {
+	if bytes.Compare(a, b) < 0 {
+		return a
+	}
+	return b
+}
+
+func maxIP(a, b net.IP) net.IP {
+	if bytes.Compare(a, b) > 0 {
+		return a
+	}
+	return b
+}
+
+// ipUsage tracks the pods having each address, per net-attach-def key
+type ipUsage struct {
+	lock sync.Mutex
+	ips  map[string]map[string]map[string]struct{}
+	// reported are the duplicate addresses last reported for each pod and net-attach-def key
+	reported map[string]map[string]string
+	// syncLock serializes metric updates, so a worker can not overwrite
+	// the metrics with usage older than the one set by another worker
+	syncLock sync.Mutex
+}
+
+func newIPUsage() *ipUsage {
+	return &ipUsage{
+		ips:      make(map[string]map[string]map[string]struct{}),
+		reported: make(map[string]map[string]string),
+	}
+}
+
+// add records the addresses of the pod and returns the ones already used by another pod
+func (u *ipUsage) add(podKey, nadKey string, ips []string) []string {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	var duplicates []string
+	nadIPs, ok := u.ips[nadKey]
+	if !ok {
+		nadIPs = make(map[string]map[string]struct{})
+		u.ips[nadKey] = nadIPs
+	}
+	for _, ip := range ips {
+		ip = canonicalIP(ip)
+		pods, ok := nadIPs[ip]
+		if !ok {
+			pods = make(map[string]struct{})
+			nadIPs[ip] = pods
+		}
+		if _, found := pods[podKey]; !found && len(pods) > 0 {
+			duplicates = append(duplicates, ip)
+		}
+		pods[podKey] = struct{}{}
+	}
+	return duplicates
+}
+
+// remove drops the addresses of the pod
+func (u *ipUsage) remove(podKey, nadKey string, ips []string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	nadIPs := u.ips[nadKey]
+	for _, ip := range ips {
+		ip = canonicalIP(ip)
+		if pods, ok := nadIPs[ip]; ok {
+			delete(pods, podKey)
+			if len(pods) == 0 {
+				delete(nadIPs, ip)
+			}
+		}
+	}
+	if len(nadIPs) == 0 {
+		delete(u.ips, nadKey)
+	}
+}
+
+// reportDuplicates records the duplicate addresses of the pod and tells whether they
+// changed since they were last recorded, so they are reported once and not on every update
+func (u *ipUsage) reportDuplicates(podKey, nadKey string, duplicates []string) bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	current := strings.Join(duplicates, ", ")
+	if u.reported[podKey][nadKey] == current {
+		return false
+	}
+	if current == "" {
+		delete(u.reported[podKey], nadKey)
+		if len(u.reported[podKey]) == 0 {
+			delete(u.reported, podKey)
+		}
+		return true
+	}
+	if u.reported[podKey] == nil {
+		u.reported[podKey] = make(map[string]string)
+	}
+	u.reported[podKey][nadKey] = current
+	return true
+}
+
+// forgetReported drops the duplicate addresses reported for a pod which is gone or
+// no longer attached
+func (u *ipUsage) forgetReported(podKey string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	delete(u.reported, podKey)
+}
+
+// usage returns the number of addresses in use within the ranges and the addresses used by several pods
+func (u *ipUsage) usage(nadKey string, ranges []ipRange) (int, []string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	inUse := 0
+	var duplicates []string
+	for ip, pods := range u.ips[nadKey] {
+		parsed := net.ParseIP(ip)
+		for _, r := range ranges {
+			if r.contains(parsed) {
+				inUse++
+				break
+			}
+		}
+		if len(pods) > 1 {
+			duplicates = append(duplicates, ip)
+		}
+	}
+	sort.Strings(duplicates)
+	return inUse, duplicates
+}
+
+// canonicalIP strips a prefix length and normalizes the address text
+func canonicalIP(ip string) string {
+	if i := strings.Index(ip, "/"); i >= 0 {
+		ip = ip[:i]
+	}
+	if parsed := net.ParseIP(ip); parsed != nil {
+		return parsed.String()
+	}
+	return ip
+}
+
+// updateIPUsage records or, on Delete, drops the addresses of the pod record and
+// refreshes the address range metrics of the affected net-attach-defs
+func (c *Controller) updateIPUsage(key string, pod *api_v1.Pod, record localmetrics.PodRecord, action metricAction) {
+	for nadKey, ips := range record.IPs {
+		if action == Delete {
+			c.ipUsage.remove(key, nadKey, ips)
+		} else if duplicates := c.ipUsage.add(key, nadKey, ips); c.ipUsage.reportDuplicates(key, nadKey, duplicates) && len(duplicates) > 0 {
+			glog.Warningf("pod %s got addresses %v from net-attach-def %s which are in use by other pods", key, duplicates, nadKey)
+			if pod != nil {
+				c.recorder.Eventf(pod, api_v1.EventTypeWarning, "DuplicateIP",
+					"Addresses %s from network attachment definition %s are in use by other pods", strings.Join(duplicates, ", "), nadKey)
+			}
+		}
+		c.syncIPRangeMetrics(nadKey)
+	}
+}
+
+// syncIPRangeMetrics exports size, usage and duplicate addresses of the net-attach-def ranges
+func (c *Controller) syncIPRangeMetrics(nadKey string) {
+	c.ipUsage.syncLock.Lock()
+	defer c.ipUsage.syncLock.Unlock()
+
+	namespace, name, _ := cache.SplitMetaNamespaceKey(nadKey)
+
+	obj, exists, err := c.nadInformer.GetIndexer().GetByKey(nadKey)
+	if err != nil || !exists {
+		localmetrics.DeleteNetAttachDefIPRangeMetrics(namespace, name)
+		return
+	}
+	nad := obj.(*networkv1.NetworkAttachmentDefinition)
+	ranges, err := parseIPRanges([]byte(nad.Spec.Config))
+	if err != nil {
+		glog.Infof("Ignoring address ranges of net-attach-def %s: %v", nadKey, err)
+	}
+	if len(ranges) == 0 {
+		localmetrics.DeleteNetAttachDefIPRangeMetrics(namespace, name)
+		return
+	}
+
+	size := new(big.Int)
+	for _, r := range ranges {
+		size.Add(size, r.size())
+	}
+	rangeSize, _ := new(big.Float).SetInt(size).Float64()
+	inUse, duplicates := c.ipUsage.usage(nadKey, ranges)
+	localmetrics.SetNetAttachDefIPRangeMetrics(namespace, name, rangeSize, inUse, len(duplicates))
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2022 Network Plumbing Working Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	api_v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// MissingReferencesPath is the debug path listing pods referencing missing net-attach-defs
+	MissingReferencesPath = "/debug/missing-references"
+)
+
+// missingReference is a pod whose networks annotation points at missing net-attach-defs
+type missingReference struct {
+	Pod     string   `json:"pod"`
+	Missing []string `json:"missing"`
+}
+
+// reportMissingNetworks records an event on the pod when the set of missing net-attach-defs
+// it references changed, so the event is not repeated on every resync
+func (c *Controller) reportMissingNetworks(pod *api_v1.Pod, oldMissing, missing []string) {
+	if len(missing) == 0 || strings.Join(oldMissing, ",") == strings.Join(missing, ",") {
+		return
+	}
+	glog.Infof("pod %s/%s references missing net-attach-defs: %v", pod.Namespace, pod.Name, missing)
+	c.recorder.Eventf(pod, api_v1.EventTypeWarning, "MissingNetworkAttachmentDefinition",
+		"%s annotation references network attachment definitions which do not exist: %s",
+		nadPodAnnotation, strings.Join(missing, ", "))
+}
+
+// missingReferences lists the pods referencing missing net-attach-defs, sorted by pod key
+func (c *Controller) missingReferences() []missingReference {
+	references := []missingReference{}
+	for key, record := range c.store.Records() {
+		if len(record.MissingNetworks) > 0 {
+			references = append(references, missingReference{Pod: key, Missing: record.MissingNetworks})
+		}
+	}
+	sort.Slice(references, func(i, j int) bool {
+		return references[i].Pod < references[j].Pod
+	})
+	return references
+}
+
+// missingReferencesHandler serves the pods referencing missing net-attach-defs as JSON
+func (c *Controller) missingReferencesHandler(w http.ResponseWriter, r *http.Request) {
+	resp, err := json.Marshal(c.missingReferences())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
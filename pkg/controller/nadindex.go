@@ -0,0 +1,113 @@
+// Copyright (c) 2022 Network Plumbing Working Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"sync"
+	"time"
+)
+
+// nadPodIndex is a reverse index from net-attach-def key (namespace/name)
+// to the keys of the pods referencing it in their networks annotation.
+// It is used to re-enqueue pods when a net-attach-def they use is changed.
+type nadPodIndex struct {
+	lock    sync.RWMutex
+	nadPods map[string]map[string]struct{}
+	podNads map[string][]string
+	// lastUsed is the time a net-attach-def lost its last referencing pod
+	lastUsed map[string]time.Time
+}
+
+func newNadPodIndex() *nadPodIndex {
+	return &nadPodIndex{
+		nadPods:  make(map[string]map[string]struct{}),
+		podNads:  make(map[string][]string),
+		lastUsed: make(map[string]time.Time),
+	}
+}
+
+// set replaces the net-attach-def keys referenced by the pod
+func (i *nadPodIndex) set(podKey string, nadKeys []string) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.removeLocked(podKey)
+	if len(nadKeys) == 0 {
+		return
+	}
+	for _, nadKey := range nadKeys {
+		pods, ok := i.nadPods[nadKey]
+		if !ok {
+			pods = make(map[string]struct{})
+			i.nadPods[nadKey] = pods
+			delete(i.lastUsed, nadKey)
+		}
+		pods[podKey] = struct{}{}
+	}
+	i.podNads[podKey] = nadKeys
+}
+
+// remove drops the pod from the index
+func (i *nadPodIndex) remove(podKey string) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.removeLocked(podKey)
+}
+
+func (i *nadPodIndex) removeLocked(podKey string) {
+	for _, nadKey := range i.podNads[podKey] {
+		if pods, ok := i.nadPods[nadKey]; ok {
+			delete(pods, podKey)
+			if len(pods) == 0 {
+				delete(i.nadPods, nadKey)
+				i.lastUsed[nadKey] = time.Now()
+			}
+		}
+	}
+	delete(i.podNads, podKey)
+}
+
+// podsFor returns the keys of the pods referencing the net-attach-def
+func (i *nadPodIndex) podsFor(nadKey string) []string {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	var podKeys []string
+	for podKey := range i.nadPods[nadKey] {
+		podKeys = append(podKeys, podKey)
+	}
+	return podKeys
+}
+
+// lastUsedAt returns whether the net-attach-def is referenced by any pod and,
+// if it is not, the time it lost its last pod (zero when never seen in use)
+func (i *nadPodIndex) lastUsedAt(nadKey string) (time.Time, bool) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	if len(i.nadPods[nadKey]) > 0 {
+		return time.Time{}, true
+	}
+	return i.lastUsed[nadKey], false
+}
+
+// forget drops the usage history of a removed net-attach-def
+func (i *nadPodIndex) forget(nadKey string) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	delete(i.lastUsed, nadKey)
+}
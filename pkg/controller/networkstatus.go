@@ -0,0 +1,79 @@
+// Copyright (c) 2022 Network Plumbing Working Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/k8snetworkplumbingwg/net-attach-def-admission-controller/pkg/localmetrics"
+	networkv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	api_v1 "k8s.io/api/core/v1"
+)
+
+// parseNetworkStatus returns the network-status annotation multus sets after CNI ADD,
+// falling back to the deprecated networks-status one. The bool is false when the pod
+// has no status yet.
+func parseNetworkStatus(pod *api_v1.Pod) ([]networkv1.NetworkStatus, bool, error) {
+	annotations := pod.GetAnnotations()
+	status, ok := annotations[networkv1.NetworkStatusAnnot]
+	if !ok {
+		status, ok = annotations[networkv1.OldNetworkStatusAnnot]
+	}
+	if !ok || status == "" {
+		return nil, false, nil
+	}
+
+	var statuses []networkv1.NetworkStatus
+	if err := json.Unmarshal([]byte(status), &statuses); err != nil {
+		return nil, false, fmt.Errorf("parseNetworkStatus: failed to parse pod network status annotation: %v", err)
+	}
+	return statuses, true, nil
+}
+
+// addNetworkStatus fills the attachment status of the record from the pod network status:
+// the number of interfaces, the IPs per net-attach-def and the requested networks that
+// were not attached. Statuses name secondary networks namespace/name, or only name with
+// older multus releases, in which case the pod namespace is implied.
+func addNetworkStatus(record *localmetrics.PodRecord, statuses []networkv1.NetworkStatus) {
+	attached := make(map[string]int)
+	record.Interfaces = len(statuses)
+	for _, status := range statuses {
+		if status.Default {
+			continue
+		}
+		key := status.Name
+		if !strings.Contains(key, "/") {
+			key = record.Namespace + "/" + key
+		}
+		attached[key]++
+		if len(status.IPs) > 0 {
+			if record.IPs == nil {
+				record.IPs = make(map[string][]string)
+			}
+			record.IPs[key] = append(record.IPs[key], status.IPs...)
+		}
+	}
+
+	for key, requested := range record.Networks {
+		if missing := requested - attached[key]; missing > 0 {
+			if record.NotAttached == nil {
+				record.NotAttached = make(map[string]int)
+			}
+			record.NotAttached[key] = missing
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2022 Network Plumbing Working Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+
+	api_v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// nonTerminalFieldSelector selects the pods which are admitted and not terminated yet
+	nonTerminalFieldSelector = "status.phase!=" + string(api_v1.PodSucceeded) + ",status.phase!=" + string(api_v1.PodFailed)
+	// netAttachDefIndex indexes the counted pods by the keys of the net-attach-defs they attach
+	netAttachDefIndex = "netAttachDef"
+)
+
+// PodCounter returns the number of admitted, non-terminal pods attached to the
+// net-attach-def of the key (namespace/name)
+type PodCounter func(netAttachDefKey string) int
+
+// EnablePodCounting makes the controller count the admitted, non-terminal pods attached
+// to each net-attach-def, and hand the counter to ready once its pods are synced. The pod
+// informer of the controller must list the non-terminal pods of all namespaces, the
+// controller keeps skipping pending pods and those of the ignored namespaces. Must be
+// called before Run
+func (c *Controller) EnablePodCounting(ignoredNamespaces []string, ready func(PodCounter)) error {
+	err := c.informer.AddIndexers(cache.Indexers{netAttachDefIndex: c.podNetAttachDefKeys})
+	if err != nil {
+		return fmt.Errorf("failed to index pods by net-attach-def: %v", err)
+	}
+	c.ignoredNamespaces = make(map[string]bool)
+	for _, ns := range ignoredNamespaces {
+		c.ignoredNamespaces[ns] = true
+	}
+	c.podCounterReady = ready
+	return nil
+}
+
+// handles tells whether the controller handles the pod of its informer, i.e. whether it
+// is running outside of the ignored namespaces
+func (c *Controller) handles(pod *api_v1.Pod) bool {
+	return pod.Status.Phase == api_v1.PodRunning && !c.ignoredNamespaces[pod.Namespace]
+}
+
+// podNetAttachDefKeys returns the keys of the net-attach-defs a non-terminal pod attaches,
+// each once
+func (c *Controller) podNetAttachDefKeys(obj interface{}) ([]string, error) {
+	pod, ok := obj.(*api_v1.Pod)
+	if !ok || pod.Status.Phase == api_v1.PodSucceeded || pod.Status.Phase == api_v1.PodFailed {
+		return nil, nil
+	}
+	annotation := pod.GetAnnotations()[nadPodAnnotation]
+	if annotation == "" {
+		return nil, nil
+	}
+	networks, err := c.parsePodNetworkAnnotation(annotation, pod.Namespace)
+	if err != nil {
+		// the webhook denies such pods, unless they are exempt
+		return nil, nil
+	}
+	var keys []string
+	seen := make(map[string]bool)
+	for _, network := range networks {
+		key := network.Namespace + "/" + network.Name
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// countPods returns the number of counted pods attached to the net-attach-def
+func (c *Controller) countPods(netAttachDefKey string) int {
+	pods, err := c.informer.GetIndexer().ByIndex(netAttachDefIndex, netAttachDefKey)
+	if err != nil {
+		return 0
+	}
+	return len(pods)
+}
@@ -0,0 +1,271 @@
+// Copyright (c) 2022 Network Plumbing Working Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/k8snetworkplumbingwg/net-attach-def-admission-controller/pkg/localmetrics"
+	api_v1 "k8s.io/api/core/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// sandboxFailureReason is the reason of the kubelet events for failed CNI ADD
+	sandboxFailureReason = "FailedCreatePodSandBox"
+	// sandboxFailureFieldSelector selects the kubelet events for failed CNI ADD
+	sandboxFailureFieldSelector = "reason=" + sandboxFailureReason + ",involvedObject.kind=Pod"
+	stuckPodCheckPeriod         = 30 * time.Second
+	// earlyEventTTL is how long a sandbox failure event waits for its pod to show up
+	// in the pending pod cache before it is dropped
+	earlyEventTTL = 5 * time.Minute
+)
+
+// stuckPods tracks Pending pods whose sandbox creation failed on their secondary networks
+type stuckPods struct {
+	lock sync.Mutex
+	// pods holds the net-attach-def keys failing for each stuck pod key
+	pods map[string]map[string]struct{}
+	// eventCounts is the last seen count of each sandbox failure event
+	eventCounts map[k8stypes.UID]int32
+	// started is when the tracking started, the counts of the events last seen before
+	// only serve as the baseline of their increases
+	started time.Time
+	// reported holds the net-attach-def keys with a stuck pod age exported
+	reported map[string]struct{}
+	// early holds the sandbox failure events seen before their pod, by pod key, with
+	// the time the first one was seen. The event and pod caches are not ordered
+	early      map[string]map[k8stypes.UID]*api_v1.Event
+	earlySince map[string]time.Time
+}
+
+func newStuckPods() *stuckPods {
+	return &stuckPods{
+		pods:        make(map[string]map[string]struct{}),
+		eventCounts: make(map[k8stypes.UID]int32),
+		started:     time.Now(),
+		reported:    make(map[string]struct{}),
+		early:       make(map[string]map[k8stypes.UID]*api_v1.Event),
+		earlySince:  make(map[string]time.Time),
+	}
+}
+
+// EnableStuckPodTracking makes the controller watch Pending pods with the networks
+// annotation and link them to sandbox failure events, must be called before Run
+func (c *Controller) EnableStuckPodTracking(pendingInformer, eventInformer cache.SharedIndexInformer) {
+	c.pendingInformer = pendingInformer
+	c.eventInformer = eventInformer
+	c.stuckPods = newStuckPods()
+
+	eventInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if event, ok := obj.(*api_v1.Event); ok {
+				c.handleSandboxFailure(event)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			if event, ok := newObj.(*api_v1.Event); ok {
+				c.handleSandboxFailure(event)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if event, ok := obj.(*api_v1.Event); ok {
+				c.stuckPods.lock.Lock()
+				delete(c.stuckPods.eventCounts, event.UID)
+				c.stuckPods.lock.Unlock()
+			}
+		},
+	})
+	// handle the events which arrived before their pod
+	handlePod := func(obj interface{}) {
+		if key, err := cache.MetaNamespaceKeyFunc(obj); err == nil {
+			for _, event := range c.stuckPods.takeEarlyEvents(key) {
+				c.handleSandboxFailure(event)
+			}
+		}
+	}
+	pendingInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: handlePod,
+		UpdateFunc: func(_, newObj interface{}) {
+			handlePod(newObj)
+		},
+	})
+}
+
+// takeEarlyEvents returns and forgets the events of the pod seen before it
+func (s *stuckPods) takeEarlyEvents(podKey string) []*api_v1.Event {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var events []*api_v1.Event
+	for _, event := range s.early[podKey] {
+		events = append(events, event)
+	}
+	delete(s.early, podKey)
+	delete(s.earlySince, podKey)
+	return events
+}
+
+// handleSandboxFailure counts the attachment failures of a sandbox failure event against the
+// net-attach-defs it mentions, or all the networks of the pod when it only mentions multus
+func (c *Controller) handleSandboxFailure(event *api_v1.Event) {
+	if event.Reason != sandboxFailureReason || event.InvolvedObject.Kind != "Pod" {
+		return
+	}
+	podKey := event.InvolvedObject.Namespace + "/" + event.InvolvedObject.Name
+	// the pod lookup and the saving of early events are atomic, so the pod handler
+	// either finds the saved event or the event finds the pod
+	c.stuckPods.lock.Lock()
+	obj, exists, err := c.pendingInformer.GetIndexer().GetByKey(podKey)
+	if err == nil && !exists {
+		if c.stuckPods.early[podKey] == nil {
+			c.stuckPods.early[podKey] = make(map[k8stypes.UID]*api_v1.Event)
+			c.stuckPods.earlySince[podKey] = time.Now()
+		}
+		c.stuckPods.early[podKey][event.UID] = event
+	}
+	c.stuckPods.lock.Unlock()
+	if err != nil || !exists {
+		return
+	}
+	pod := obj.(*api_v1.Pod)
+	if pod.UID != event.InvolvedObject.UID && event.InvolvedObject.UID != "" {
+		return
+	}
+	annotation, ok := pod.GetAnnotations()[nadPodAnnotation]
+	if !ok {
+		return
+	}
+	networks, err := c.parsePodNetworkAnnotation(annotation, pod.Namespace)
+	if err != nil {
+		return
+	}
+
+	var failing []string
+	for _, network := range networks {
+		if mentionsNetwork(event.Message, network.Namespace, network.Name) {
+			failing = append(failing, network.Namespace+"/"+network.Name)
+		}
+	}
+	if len(failing) == 0 && strings.Contains(strings.ToLower(event.Message), "multus") {
+		for _, network := range networks {
+			failing = append(failing, network.Namespace+"/"+network.Name)
+		}
+	}
+	if len(failing) == 0 {
+		return
+	}
+
+	c.stuckPods.lock.Lock()
+	defer c.stuckPods.lock.Unlock()
+
+	count := event.Count
+	if count < 1 {
+		count = 1
+	}
+	lastCount, seen := c.stuckPods.eventCounts[event.UID]
+	c.stuckPods.eventCounts[event.UID] = count
+	if !seen && c.isHistorical(event) {
+		glog.V(4).Infof("not counting the %d past failures of event %s/%s", count, event.Namespace, event.Name)
+		return
+	}
+	failures := int(count - lastCount)
+	if failures <= 0 {
+		return
+	}
+	nads, ok := c.stuckPods.pods[podKey]
+	if !ok {
+		nads = make(map[string]struct{})
+		c.stuckPods.pods[podKey] = nads
+	}
+	glog.Infof("pod %s failed to attach networks %v: %s", podKey, failing, event.Message)
+	for _, nadKey := range failing {
+		nads[nadKey] = struct{}{}
+		nadNamespace, nadName, _ := cache.SplitMetaNamespaceKey(nadKey)
+		localmetrics.AddNetAttachDefAttachmentFailures(nadNamespace, nadName, failures)
+	}
+}
+
+// isHistorical tells whether the failures of a sandbox failure event seen for the first time
+// happened before the tracking started: the events of the initial list of the informer, or
+// which were last seen before. Counting them would make the failures jump at every restart
+func (c *Controller) isHistorical(event *api_v1.Event) bool {
+	if !c.eventInformer.HasSynced() {
+		return true
+	}
+	return !event.LastTimestamp.IsZero() && event.LastTimestamp.Time.Before(c.stuckPods.started)
+}
+
+// mentionsNetwork tells whether the event message refers to the net-attach-def, the way
+// multus does in its errors, e.g. network "name" or network-attachment-definition (name)
+func mentionsNetwork(message, namespace, name string) bool {
+	for _, ref := range []string{namespace + "/" + name, `"` + name + `"`, "(" + name + ")"} {
+		if strings.Contains(message, ref) {
+			return true
+		}
+	}
+	return false
+}
+
+// syncStuckPods exports the age of the oldest pod stuck on each net-attach-def and
+// forgets pods which are no longer Pending, and early events whose pod never showed up
+func (c *Controller) syncStuckPods() {
+	now := time.Now()
+	oldest := make(map[string]time.Duration)
+
+	c.stuckPods.lock.Lock()
+	defer c.stuckPods.lock.Unlock()
+
+	for podKey, nads := range c.stuckPods.pods {
+		obj, exists, err := c.pendingInformer.GetIndexer().GetByKey(podKey)
+		if err != nil || !exists {
+			delete(c.stuckPods.pods, podKey)
+			continue
+		}
+		age := now.Sub(obj.(*api_v1.Pod).CreationTimestamp.Time)
+		for nadKey := range nads {
+			if age > oldest[nadKey] {
+				oldest[nadKey] = age
+			}
+		}
+	}
+
+	for podKey, since := range c.stuckPods.earlySince {
+		if now.Sub(since) > earlyEventTTL {
+			delete(c.stuckPods.early, podKey)
+			delete(c.stuckPods.earlySince, podKey)
+		}
+	}
+
+	for nadKey, age := range oldest {
+		nadNamespace, nadName, _ := cache.SplitMetaNamespaceKey(nadKey)
+		localmetrics.SetNetAttachDefStuckPodAge(nadNamespace, nadName, age.Seconds())
+		c.stuckPods.reported[nadKey] = struct{}{}
+	}
+	for nadKey := range c.stuckPods.reported {
+		if _, ok := oldest[nadKey]; !ok {
+			nadNamespace, nadName, _ := cache.SplitMetaNamespaceKey(nadKey)
+			localmetrics.DeleteNetAttachDefStuckPodAge(nadNamespace, nadName)
+			delete(c.stuckPods.reported, nadKey)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2022 Network Plumbing Working Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/k8snetworkplumbingwg/net-attach-def-admission-controller/pkg/localmetrics"
+	networkv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	api_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// unusedSinceAnnotation is set on unused net-attach-defs when AnnotateUnused is enabled
+	unusedSinceAnnotation = "netattach.k8s.cni.cncf.io/unused-since"
+	maxUnusedCheckPeriod  = time.Minute
+)
+
+func unusedCheckPeriod(gracePeriod time.Duration) time.Duration {
+	if gracePeriod < maxUnusedCheckPeriod {
+		return gracePeriod
+	}
+	return maxUnusedCheckPeriod
+}
+
+// detectUnused reports net-attach-defs which no running pod has referenced for the grace period.
+// A net-attach-def is unused since the later of its creation, the controller start and the
+// time its last referencing pod went away.
+func (c *Controller) detectUnused() {
+	now := time.Now()
+	existing := make(map[string]struct{})
+
+	for _, obj := range c.nadInformer.GetStore().List() {
+		nad, ok := obj.(*networkv1.NetworkAttachmentDefinition)
+		if !ok {
+			continue
+		}
+		key := nad.Namespace + "/" + nad.Name
+		existing[key] = struct{}{}
+
+		lastUsed, inUse := c.nadIndex.lastUsedAt(key)
+		ignoredLastUsed, ignoredInUse := c.ignoredIndex.lastUsedAt(key)
+		inUse = inUse || ignoredInUse
+		unusedSince := c.startTime
+		for _, t := range []time.Time{nad.CreationTimestamp.Time, lastUsed, ignoredLastUsed} {
+			if t.After(unusedSince) {
+				unusedSince = t
+			}
+		}
+		unused := !inUse && now.Sub(unusedSince) >= c.unusedGracePeriod
+
+		if unused && !c.unused[key] {
+			glog.Infof("net-attach-def %s is not used by any running pod since %s", key, unusedSince.Format(time.RFC3339))
+			c.unused[key] = true
+			localmetrics.SetNetAttachDefUnused(nad.Namespace, nad.Name, true)
+			c.recorder.Eventf(nad, api_v1.EventTypeNormal, "Unused",
+				"Not referenced by any running pod since %s", unusedSince.Format(time.RFC3339))
+		} else if !unused && c.unused[key] {
+			glog.Infof("net-attach-def %s is used again", key)
+			delete(c.unused, key)
+			localmetrics.SetNetAttachDefUnused(nad.Namespace, nad.Name, false)
+		}
+		if c.annotateUnused {
+			c.syncUnusedAnnotation(nad, unused, unusedSince)
+		}
+	}
+
+	// drop the metrics of removed net-attach-defs
+	for key := range c.unused {
+		if _, ok := existing[key]; !ok {
+			delete(c.unused, key)
+			namespace, name, _ := cache.SplitMetaNamespaceKey(key)
+			localmetrics.SetNetAttachDefUnused(namespace, name, false)
+		}
+	}
+}
+
+// TrackIgnoredUsage makes the unused detection count the pods of the informer, which the
+// controller otherwise ignores, as users of the net-attach-defs they reference. Must be
+// called before Run
+func (c *Controller) TrackIgnoredUsage(podInformer cache.SharedIndexInformer) {
+	c.ignoredInformers = append(c.ignoredInformers, podInformer)
+	indexPod := func(obj interface{}) {
+		if key, err := cache.MetaNamespaceKeyFunc(obj); err == nil {
+			nadKeys, _ := c.podNetAttachDefKeys(obj)
+			c.ignoredIndex.set(key, nadKeys)
+		}
+	}
+	podInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: indexPod,
+		UpdateFunc: func(_, newObj interface{}) {
+			indexPod(newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj); err == nil {
+				c.ignoredIndex.remove(key)
+			}
+		},
+	})
+}
+
+// syncUnusedAnnotation sets or removes the unused-since annotation of the net-attach-def
+func (c *Controller) syncUnusedAnnotation(nad *networkv1.NetworkAttachmentDefinition, unused bool, unusedSince time.Time) {
+	_, annotated := nad.GetAnnotations()[unusedSinceAnnotation]
+	if unused == annotated {
+		return
+	}
+
+	var value interface{} // null removes the annotation
+	if unused {
+		value = unusedSince.UTC().Format(time.RFC3339)
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{unusedSinceAnnotation: value},
+		},
+	})
+	if err != nil {
+		glog.Errorf("failed to prepare annotation patch for net-attach-def %s/%s: %v", nad.Namespace, nad.Name, err)
+		return
+	}
+	_, err = c.nadClientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions(nad.Namespace).Patch(context.TODO(),
+		nad.Name, k8stypes.MergePatchType, patch, meta_v1.PatchOptions{})
+	if err != nil {
+		glog.Errorf("failed to update %s annotation of net-attach-def %s/%s: %v", unusedSinceAnnotation, nad.Namespace, nad.Name, err)
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright (c) 2022 Network Plumbing Working Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package exemption decides which requests and objects are exempt from
+// enforcement, shared by the webhook handlers and the controller
+package exemption
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/k8snetworkplumbingwg/net-attach-def-admission-controller/pkg/localmetrics"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Reasons for an exemption, used in logs and as metric label
+const (
+	ReasonNamespace         = "namespace"
+	ReasonNamespaceSelector = "namespace-selector"
+	ReasonUser              = "user"
+	ReasonGroup             = "group"
+	ReasonServiceAccount    = "service-account"
+	ReasonObjectSelector    = "object-selector"
+)
+
+const serviceAccountUserPrefix = "system:serviceaccount:"
+
+// Config lists what is exempt from enforcement. Service accounts are given
+// as namespace/name, a name of * exempts all service accounts of the namespace
+type Config struct {
+	Namespaces        []string
+	NamespaceSelector labels.Selector
+	Users             []string
+	Groups            []string
+	ServiceAccounts   []string
+	ObjectSelector    labels.Selector
+}
+
+// NamespaceLabelsFunc returns the labels of the named namespace
+type NamespaceLabelsFunc func(namespace string) (map[string]string, error)
+
+// Subject is checked for exemptions, the user and groups are only known
+// for admission requests
+type Subject struct {
+	Namespace string
+	User      string
+	Groups    []string
+	Labels    map[string]string
+}
+
+// Exemptions checks subjects against the configured exemptions, a nil
+// Exemptions exempts nothing
+type Exemptions struct {
+	namespaces        map[string]bool
+	namespaceSelector labels.Selector
+	users             map[string]bool
+	groups            map[string]bool
+	serviceAccounts   map[string]bool
+	objectSelector    labels.Selector
+	namespaceLabels   NamespaceLabelsFunc
+}
+
+// ParseConfig builds a Config from comma separated lists and label selectors
+// as given on the command line
+func ParseConfig(namespaces, namespaceSelector, users, groups, serviceAccounts, objectSelector string) (Config, error) {
+	var err error
+	config := Config{
+		Namespaces:      splitList(namespaces),
+		Users:           splitList(users),
+		Groups:          splitList(groups),
+		ServiceAccounts: splitList(serviceAccounts),
+	}
+	for _, sa := range config.ServiceAccounts {
+		if parts := strings.Split(sa, "/"); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return config, fmt.Errorf("invalid service account %q, expected namespace/name", sa)
+		}
+	}
+	if namespaceSelector != "" {
+		if config.NamespaceSelector, err = labels.Parse(namespaceSelector); err != nil {
+			return config, fmt.Errorf("invalid namespace selector: %v", err)
+		}
+	}
+	if objectSelector != "" {
+		if config.ObjectSelector, err = labels.Parse(objectSelector); err != nil {
+			return config, fmt.Errorf("invalid object selector: %v", err)
+		}
+	}
+	return config, nil
+}
+
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func toSet(items []string) map[string]bool {
+	set := make(map[string]bool, len(items))
+	for _, item := range items {
+		set[item] = true
+	}
+	return set
+}
+
+// New returns the exemptions of the config, namespaceLabels looks up the
+// labels matched by the namespace selector and may be nil without one
+func New(config Config, namespaceLabels NamespaceLabelsFunc) *Exemptions {
+	return &Exemptions{
+		namespaces:        toSet(config.Namespaces),
+		namespaceSelector: config.NamespaceSelector,
+		users:             toSet(config.Users),
+		groups:            toSet(config.Groups),
+		serviceAccounts:   toSet(config.ServiceAccounts),
+		objectSelector:    config.ObjectSelector,
+		namespaceLabels:   namespaceLabels,
+	}
+}
+
+// Reason returns why the subject is exempt, or an empty string if it is not
+func (e *Exemptions) Reason(subject Subject) string {
+	if e == nil {
+		return ""
+	}
+	if e.namespaces[subject.Namespace] {
+		return ReasonNamespace
+	}
+	if e.namespaceSelector != nil && !e.namespaceSelector.Empty() && subject.Namespace != "" && e.namespaceLabels != nil {
+		nsLabels, err := e.namespaceLabels(subject.Namespace)
+		if err != nil {
+			glog.Warningf("cannot check namespace %s for exemption: %v", subject.Namespace, err)
+		} else if e.namespaceSelector.Matches(labels.Set(nsLabels)) {
+			return ReasonNamespaceSelector
+		}
+	}
+	if subject.User != "" {
+		if e.users[subject.User] {
+			return ReasonUser
+		}
+		if strings.HasPrefix(subject.User, serviceAccountUserPrefix) {
+			parts := strings.Split(strings.TrimPrefix(subject.User, serviceAccountUserPrefix), ":")
+			if len(parts) == 2 && (e.serviceAccounts[parts[0]+"/"+parts[1]] || e.serviceAccounts[parts[0]+"/*"]) {
+				return ReasonServiceAccount
+			}
+		}
+	}
+	for _, group := range subject.Groups {
+		if e.groups[group] {
+			return ReasonGroup
+		}
+	}
+	if e.objectSelector != nil && !e.objectSelector.Empty() && e.objectSelector.Matches(labels.Set(subject.Labels)) {
+		return ReasonObjectSelector
+	}
+	return ""
+}
+
+// Exempt returns why the subject is exempt from enforcement by the component,
+// or an empty string if it is not. Exemptions are logged and counted, the
+// description names the request or object in the log
+func (e *Exemptions) Exempt(component, description string, subject Subject) string {
+	reason := e.Reason(subject)
+	if reason != "" {
+		glog.Infof("%s: %s exempt by %s", component, description, reason)
+		localmetrics.IncNetAttachDefExemptions(component, reason)
+	}
+	return reason
+}
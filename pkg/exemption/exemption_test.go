@@ -0,0 +1,83 @@
+// Copyright (c) 2022 Network Plumbing Working Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exemption
+
+import (
+	"fmt"
+
+	"github.com/k8snetworkplumbingwg/net-attach-def-admission-controller/pkg/localmetrics"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Exemptions", func() {
+	namespaceLabels := func(namespace string) (map[string]string, error) {
+		switch namespace {
+		case "labeled-namespace":
+			return map[string]string{"exempt": "true"}, nil
+		case "missing-namespace":
+			return nil, fmt.Errorf("namespace %s not found", namespace)
+		}
+		return nil, nil
+	}
+	config, err := ParseConfig("kube-system, other-system", "exempt=true", "admin", "system:masters",
+		"some-namespace/some-sa,operators/*", "exempt=true")
+	if err != nil {
+		panic(err)
+	}
+	exemptions := New(config, namespaceLabels)
+
+	DescribeTable("should tell why subjects are exempt",
+		func(subject Subject, reason string) {
+			Expect(exemptions.Reason(subject)).To(Equal(reason))
+		},
+		Entry("nothing matching", Subject{Namespace: "some-namespace", User: "some-user"}, ""),
+		Entry("listed namespace", Subject{Namespace: "other-system"}, ReasonNamespace),
+		Entry("namespace matching the selector", Subject{Namespace: "labeled-namespace"}, ReasonNamespaceSelector),
+		Entry("namespace failing the lookup", Subject{Namespace: "missing-namespace"}, ""),
+		Entry("listed user", Subject{Namespace: "some-namespace", User: "admin"}, ReasonUser),
+		Entry("listed group", Subject{Namespace: "some-namespace", Groups: []string{"system:authenticated", "system:masters"}}, ReasonGroup),
+		Entry("listed service account", Subject{User: "system:serviceaccount:some-namespace:some-sa"}, ReasonServiceAccount),
+		Entry("other service account of the namespace", Subject{User: "system:serviceaccount:some-namespace:other-sa"}, ""),
+		Entry("service account of a wildcard namespace", Subject{User: "system:serviceaccount:operators:any-sa"}, ReasonServiceAccount),
+		Entry("object matching the selector", Subject{Namespace: "some-namespace", Labels: map[string]string{"exempt": "true"}}, ReasonObjectSelector),
+		Entry("object not matching the selector", Subject{Namespace: "some-namespace", Labels: map[string]string{"exempt": "false"}}, ""),
+	)
+
+	It("should exempt nothing without exemptions", func() {
+		var none *Exemptions
+		Expect(none.Reason(Subject{Namespace: "kube-system"})).To(BeEmpty())
+		Expect(New(Config{}, nil).Reason(Subject{Namespace: "kube-system", User: "admin"})).To(BeEmpty())
+	})
+
+	It("should count exemptions per component and reason", func() {
+		before := testutil.ToFloat64(localmetrics.NetAttachDefExemptions.WithLabelValues("validate", ReasonUser))
+		Expect(exemptions.Exempt("validate", "some request", Subject{User: "admin"})).To(Equal(ReasonUser))
+		Expect(exemptions.Exempt("validate", "some request", Subject{User: "some-user"})).To(BeEmpty())
+		Expect(testutil.ToFloat64(localmetrics.NetAttachDefExemptions.WithLabelValues("validate", ReasonUser))).To(Equal(before + 1))
+	})
+
+	DescribeTable("should reject invalid configurations",
+		func(namespaceSelector, serviceAccounts, objectSelector string) {
+			_, err := ParseConfig("", namespaceSelector, "", "", serviceAccounts, objectSelector)
+			Expect(err).To(HaveOccurred())
+		},
+		Entry("invalid namespace selector", "exempt in (", "", ""),
+		Entry("service account without namespace", "", "some-sa", ""),
+		Entry("invalid object selector", "", "", "!!"),
+	)
+})
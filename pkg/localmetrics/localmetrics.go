@@ -15,6 +15,11 @@
 package localmetrics
 
 import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/golang/glog"
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -23,14 +28,18 @@ const (
 	metricStoreInitSize int = 330
 	initialMetricsCount int = 0
 	metricsIncVal       int = 1
+	anyNetworkType          = "any"
 )
 
 var (
-	netAttachDefInstanceEnabledCount        = initialMetricsCount
-	netAttachDefInstanceSriovEnabledCount   = initialMetricsCount
-	netAttachDefInstanceIBSriovEnabledCount = initialMetricsCount
-	//Change this when we set metrics per node.
-	objStore = make(map[string]string, metricStoreInitSize) // Preallocate room 110 entires per node*3
+	// counterLock guards the enabled instance counters below, metrics are
+	// updated by several controller workers at once
+	counterLock sync.Mutex
+	// enabledInstanceCounts counts instances per network type tracked by
+	// NetAttachDefEnabledInstanceUp, "any" is always tracked
+	enabledInstanceCounts = map[string]int{anyNetworkType: initialMetricsCount}
+	//DefaultEnabledInstanceTypes ... network types tracked by NetAttachDefEnabledInstanceUp unless configured
+	DefaultEnabledInstanceTypes = []string{"sriov", "ib-sriov"}
 	//NetAttachDefInstanceCounter ...  Total no of network attachment definition instance in the cluster
 	NetAttachDefInstanceCounter = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
@@ -43,8 +52,167 @@ var (
 			Name: "network_attachment_definition_enabled_instance_up",
 			Help: "Metric to identify clusters with network attachment definition enabled instances.",
 		}, []string{"networks"})
+	//NetAttachDefNamespaceInstanceCounter ... no of running pods attaching a network attachment definition per namespace
+	NetAttachDefNamespaceInstanceCounter = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_attachment_definition_namespace_instances",
+			Help: "Metric to get number of running pods using network attachment definitions per namespace.",
+		}, []string{"namespace"})
+	//NetAttachDefPodCounter ... no of running pods attaching each network attachment definition
+	NetAttachDefPodCounter = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_attachment_definition_pods",
+			Help: "Metric to get number of running pods attaching the network attachment definition.",
+		}, []string{"namespace", "name"})
+	//NetAttachDefAttachmentCounter ... no of attachments of each network attachment definition, duplicates included
+	NetAttachDefAttachmentCounter = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_attachment_definition_attachments",
+			Help: "Metric to get number of interfaces attached from the network attachment definition by running pods.",
+		}, []string{"namespace", "name"})
+	//NetAttachDefNodeInstanceCounter ... no of running pods per node and network type
+	NetAttachDefNodeInstanceCounter = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_attachment_definition_node_instances",
+			Help: "Metric to get number of running pods using network attachment definition per node.",
+		}, []string{"node", "networks"})
+	//NetAttachDefUnused ... network attachment definitions not referenced by any running pod for the grace period
+	NetAttachDefUnused = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_attachment_definition_unused",
+			Help: "Metric to identify network attachment definitions not used by any running pod for the grace period.",
+		}, []string{"namespace", "name"})
+	//NetAttachDefMissingReferenceCounter ... no of references to missing network attachment definitions per pod namespace
+	NetAttachDefMissingReferenceCounter = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_attachment_definition_missing_references",
+			Help: "Metric to get number of references of running pods to network attachment definitions which do not exist.",
+		}, []string{"namespace"})
+	//NetAttachDefNotAttachedCounter ... no of requested attachments missing from the pods network status
+	NetAttachDefNotAttachedCounter = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_attachment_definition_requested_not_attached",
+			Help: "Metric to get number of attachments of the network attachment definition requested by running pods but missing from their network status.",
+		}, []string{"namespace", "name"})
+	//NetAttachDefPodInterfacesCounter ... no of running pods by number of interfaces in their network status
+	NetAttachDefPodInterfacesCounter = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_attachment_definition_pod_interfaces",
+			Help: "Metric to get number of running pods with the given number of interfaces in their network status.",
+		}, []string{"interfaces"})
+	//NetAttachDefIPsInUseCounter ... no of IP addresses in use per network attachment definition
+	NetAttachDefIPsInUseCounter = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_attachment_definition_ips_in_use",
+			Help: "Metric to get number of IP addresses of running pods attached from the network attachment definition.",
+		}, []string{"namespace", "name"})
+	//NetAttachDefIPRangeSize ... no of allocatable addresses in the IPAM ranges of the network attachment definition
+	NetAttachDefIPRangeSize = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_attachment_definition_ip_range_size",
+			Help: "Metric to get number of allocatable addresses in the IPAM ranges of the network attachment definition.",
+		}, []string{"namespace", "name"})
+	//NetAttachDefIPRangeInUse ... no of addresses in the IPAM ranges in use by running pods
+	NetAttachDefIPRangeInUse = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_attachment_definition_ip_range_in_use",
+			Help: "Metric to get number of addresses in the IPAM ranges of the network attachment definition in use by running pods.",
+		}, []string{"namespace", "name"})
+	//NetAttachDefIPRangeUtilization ... ratio of addresses in use to the size of the IPAM ranges
+	NetAttachDefIPRangeUtilization = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_attachment_definition_ip_range_utilization",
+			Help: "Metric to get ratio of addresses in use to allocatable addresses in the IPAM ranges of the network attachment definition.",
+		}, []string{"namespace", "name"})
+	//NetAttachDefDuplicateIPs ... no of addresses of the network attachment definition in use by more than one pod
+	NetAttachDefDuplicateIPs = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_attachment_definition_duplicate_ips",
+			Help: "Metric to get number of addresses of the network attachment definition in use by more than one running pod.",
+		}, []string{"namespace", "name"})
+	//NetAttachDefAttachmentFailures ... no of failed attachments of the network attachment definition
+	NetAttachDefAttachmentFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "network_attachment_definition_attachment_failures_total",
+			Help: "Metric to get number of pod sandbox creation failures attaching the network attachment definition.",
+		}, []string{"namespace", "name"})
+	//NetAttachDefStuckPodAge ... age of the oldest pending pod failing to attach the network attachment definition
+	NetAttachDefStuckPodAge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_attachment_definition_stuck_pod_max_age_seconds",
+			Help: "Metric to get age of the oldest pending pod failing to attach the network attachment definition.",
+		}, []string{"namespace", "name"})
+	//NetAttachDefAuditViolations ... no of network attachment definitions violating an admission rule at the last audit
+	NetAttachDefAuditViolations = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_attachment_definition_audit_violations",
+			Help: "Metric to get number of network attachment definitions violating an admission rule at the last audit.",
+		}, []string{"rule"})
+	//NetAttachDefPodAuditViolations ... no of running pods violating an isolation rule at the last audit
+	NetAttachDefPodAuditViolations = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "network_attachment_definition_pod_audit_violations",
+			Help: "Metric to get number of running pods violating an isolation rule at the last audit, per namespace.",
+		}, []string{"namespace", "rule"})
+	//NetAttachDefAuditLastRun ... time of the last audit of the network attachment definitions
+	NetAttachDefAuditLastRun = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "network_attachment_definition_audit_last_run_timestamp_seconds",
+			Help: "Metric to get start time of the last audit of the network attachment definitions.",
+		})
+	//NetAttachDefAuditDuration ... duration of the last audit of the network attachment definitions
+	NetAttachDefAuditDuration = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "network_attachment_definition_audit_duration_seconds",
+			Help: "Metric to get duration of the last audit of the network attachment definitions.",
+		})
+	//NetAttachDefExemptions ... no of requests and objects exempt from enforcement, per component and reason
+	NetAttachDefExemptions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "network_attachment_definition_exemptions_total",
+			Help: "Metric to get number of admission requests exempt from enforcement.",
+		}, []string{"component", "reason"})
+
+	namespaceInstanceCounts = newGaugeCounts(NetAttachDefNamespaceInstanceCounter)
+	nodeInstanceCounts      = newGaugeCounts(NetAttachDefNodeInstanceCounter)
+	missingReferenceCounts  = newGaugeCounts(NetAttachDefMissingReferenceCounter)
+	notAttachedCounts       = newGaugeCounts(NetAttachDefNotAttachedCounter)
+	podInterfacesCounts     = newGaugeCounts(NetAttachDefPodInterfacesCounter)
+	ipsInUseCounts          = newGaugeCounts(NetAttachDefIPsInUseCounter)
+	podCounts               = newGaugeCounts(NetAttachDefPodCounter)
+	attachmentCounts        = newGaugeCounts(NetAttachDefAttachmentCounter)
 )
 
+// gaugeCounts keeps the value behind each label set of a gauge, so that label
+// sets dropping to zero are removed instead of being exported forever
+type gaugeCounts struct {
+	lock   sync.Mutex
+	gauge  *prometheus.GaugeVec
+	counts map[string]int
+}
+
+func newGaugeCounts(gauge *prometheus.GaugeVec) *gaugeCounts {
+	return &gaugeCounts{
+		gauge:  gauge,
+		counts: make(map[string]int),
+	}
+}
+
+func (g *gaugeCounts) add(val int, labels ...string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	key := strings.Join(labels, "\x00")
+	count := g.counts[key] + val
+	if count <= initialMetricsCount {
+		delete(g.counts, key)
+		g.gauge.DeleteLabelValues(labels...)
+		return
+	}
+	g.counts[key] = count
+	g.gauge.WithLabelValues(labels...).Set(float64(count))
+}
+
 //UpdateNetAttachDefInstanceMetrics ...
 func UpdateNetAttachDefInstanceMetrics(tp string, val int) {
 
@@ -52,23 +220,12 @@ func UpdateNetAttachDefInstanceMetrics(tp string, val int) {
 	NetAttachDefInstanceCounter.With(prometheus.Labels{
 		"networks": tp}).Add(float64(val))
 
-	if tp == "sriov" {
-		netAttachDefInstanceSriovEnabledCount += val
-		if netAttachDefInstanceSriovEnabledCount > initialMetricsCount {
-			SetNetAttachDefEnabledInstanceUp(tp, metricsIncVal)
-		} else {
-			SetNetAttachDefEnabledInstanceUp(tp, initialMetricsCount)
-		}
-	} else if tp == "ib-sriov" {
-		netAttachDefInstanceIBSriovEnabledCount += val
-		if netAttachDefInstanceIBSriovEnabledCount > initialMetricsCount {
-			SetNetAttachDefEnabledInstanceUp(tp, metricsIncVal)
-		} else {
-			SetNetAttachDefEnabledInstanceUp(tp, initialMetricsCount)
-		}
-	} else if tp == "any" {
-		netAttachDefInstanceEnabledCount += val
-		if netAttachDefInstanceEnabledCount > initialMetricsCount {
+	counterLock.Lock()
+	defer counterLock.Unlock()
+	if count, ok := enabledInstanceCounts[tp]; ok {
+		count += val
+		enabledInstanceCounts[tp] = count
+		if count > initialMetricsCount {
 			SetNetAttachDefEnabledInstanceUp(tp, metricsIncVal)
 		} else {
 			SetNetAttachDefEnabledInstanceUp(tp, initialMetricsCount)
@@ -83,29 +240,205 @@ func SetNetAttachDefEnabledInstanceUp(tp string, val int) {
 		"networks": tp}).Set(float64(val))
 }
 
-//InitMetrics ... empty metrics
-func InitMetrics() {
-	UpdateNetAttachDefInstanceMetrics("any", initialMetricsCount)
-	UpdateNetAttachDefInstanceMetrics("sriov", initialMetricsCount)
-	UpdateNetAttachDefInstanceMetrics("ib-sriov", initialMetricsCount)
+//UpdateNetAttachDefNamespaceMetrics ... update no of pods using network attachment definitions in the namespace
+func UpdateNetAttachDefNamespaceMetrics(namespace string, val int) {
+	namespaceInstanceCounts.add(val, namespace)
+}
+
+//UpdateNetAttachDefUsageMetrics ... update no of pods and attachments of the network attachment definition
+func UpdateNetAttachDefUsageMetrics(namespace, name string, pods, attachments int) {
+	podCounts.add(pods, namespace, name)
+	attachmentCounts.add(attachments, namespace, name)
+}
+
+//UpdateNetAttachDefNodeMetrics ... update no of pods using the network type on the node
+func UpdateNetAttachDefNodeMetrics(node, tp string, val int) {
+	nodeInstanceCounts.add(val, node, tp)
+}
+
+//UpdateNetAttachDefMissingReferenceMetrics ... update no of references to missing network attachment definitions in the namespace
+func UpdateNetAttachDefMissingReferenceMetrics(namespace string, val int) {
+	missingReferenceCounts.add(val, namespace)
+}
+
+//UpdateNetAttachDefNotAttachedMetrics ... update no of requested but not attached attachments of the network attachment definition
+func UpdateNetAttachDefNotAttachedMetrics(namespace, name string, val int) {
+	notAttachedCounts.add(val, namespace, name)
+}
+
+//UpdateNetAttachDefPodInterfacesMetrics ... update no of pods having the number of interfaces
+func UpdateNetAttachDefPodInterfacesMetrics(interfaces int, val int) {
+	podInterfacesCounts.add(val, strconv.Itoa(interfaces))
 }
 
-//GetStoredValue ... Get stroed config value for pod key
-func GetStoredValue(key string) string {
-	if value, ok := objStore[key]; ok {
-		return value
+//UpdateNetAttachDefIPsInUseMetrics ... update no of IP addresses in use of the network attachment definition
+func UpdateNetAttachDefIPsInUseMetrics(namespace, name string, val int) {
+	ipsInUseCounts.add(val, namespace, name)
+}
+
+//SetNetAttachDefIPRangeMetrics ... set address range metrics of the network attachment definition
+func SetNetAttachDefIPRangeMetrics(namespace, name string, size float64, inUse int, duplicates int) {
+	NetAttachDefIPRangeSize.WithLabelValues(namespace, name).Set(size)
+	NetAttachDefIPRangeInUse.WithLabelValues(namespace, name).Set(float64(inUse))
+	if size > 0 {
+		NetAttachDefIPRangeUtilization.WithLabelValues(namespace, name).Set(float64(inUse) / size)
+	} else {
+		NetAttachDefIPRangeUtilization.DeleteLabelValues(namespace, name)
 	}
-	return ""
+	NetAttachDefDuplicateIPs.WithLabelValues(namespace, name).Set(float64(duplicates))
 }
 
-//SetStoredValue // set stored key value
-func SetStoredValue(key string, val string) {
-	if val == "" {
-		_, ok := objStore[key]
-		if ok {
-			delete(objStore, key)
-		}
+//DeleteNetAttachDefIPRangeMetrics ... drop address range metrics of the network attachment definition
+func DeleteNetAttachDefIPRangeMetrics(namespace, name string) {
+	NetAttachDefIPRangeSize.DeleteLabelValues(namespace, name)
+	NetAttachDefIPRangeInUse.DeleteLabelValues(namespace, name)
+	NetAttachDefIPRangeUtilization.DeleteLabelValues(namespace, name)
+	NetAttachDefDuplicateIPs.DeleteLabelValues(namespace, name)
+}
+
+//AddNetAttachDefAttachmentFailures ... count failed attachments of the network attachment definition
+func AddNetAttachDefAttachmentFailures(namespace, name string, val int) {
+	NetAttachDefAttachmentFailures.WithLabelValues(namespace, name).Add(float64(val))
+}
+
+//IncNetAttachDefExemptions ... count a request or object exempt from enforcement by the component
+func IncNetAttachDefExemptions(component, reason string) {
+	NetAttachDefExemptions.WithLabelValues(component, reason).Inc()
+}
+
+//SetNetAttachDefStuckPodAge ... set age of the oldest pod stuck attaching the network attachment definition
+func SetNetAttachDefStuckPodAge(namespace, name string, seconds float64) {
+	NetAttachDefStuckPodAge.WithLabelValues(namespace, name).Set(seconds)
+}
+
+//DeleteNetAttachDefStuckPodAge ... drop the stuck pod age once no pod is stuck attaching the network attachment definition
+func DeleteNetAttachDefStuckPodAge(namespace, name string) {
+	NetAttachDefStuckPodAge.DeleteLabelValues(namespace, name)
+}
+
+//SetNetAttachDefAuditViolations ... set number of network attachment definitions violating the rule, 0 drops the rule
+func SetNetAttachDefAuditViolations(rule string, count int) {
+	if count == 0 {
+		NetAttachDefAuditViolations.DeleteLabelValues(rule)
+		return
+	}
+	NetAttachDefAuditViolations.WithLabelValues(rule).Set(float64(count))
+}
+
+//SetNetAttachDefPodAuditViolations ... set number of running pods of the namespace violating the rule, 0 drops the series
+func SetNetAttachDefPodAuditViolations(namespace, rule string, count int) {
+	if count == 0 {
+		NetAttachDefPodAuditViolations.DeleteLabelValues(namespace, rule)
+		return
+	}
+	NetAttachDefPodAuditViolations.WithLabelValues(namespace, rule).Set(float64(count))
+}
+
+//SetNetAttachDefAuditRun ... set start time and duration of the last audit
+func SetNetAttachDefAuditRun(start time.Time, duration time.Duration) {
+	NetAttachDefAuditLastRun.Set(float64(start.Unix()))
+	NetAttachDefAuditDuration.Set(duration.Seconds())
+}
+
+//SetNetAttachDefUnused ... flag the network attachment definition as unused, or drop the flag
+func SetNetAttachDefUnused(namespace, name string, unused bool) {
+	if unused {
+		NetAttachDefUnused.WithLabelValues(namespace, name).Set(float64(metricsIncVal))
 	} else {
-		objStore[key] = val
+		NetAttachDefUnused.DeleteLabelValues(namespace, name)
+	}
+}
+
+//InitMetrics ... empty metrics, enabledInstanceTypes are the network types tracked
+// by NetAttachDefEnabledInstanceUp besides "any"
+func InitMetrics(enabledInstanceTypes []string) {
+	var types []string
+	counterLock.Lock()
+	for _, tp := range enabledInstanceTypes {
+		tp = strings.TrimSpace(tp)
+		if _, ok := enabledInstanceCounts[tp]; !ok && tp != "" {
+			enabledInstanceCounts[tp] = initialMetricsCount
+			types = append(types, tp)
+		}
+	}
+	counterLock.Unlock()
+
+	UpdateNetAttachDefInstanceMetrics(anyNetworkType, initialMetricsCount)
+	for _, tp := range types {
+		UpdateNetAttachDefInstanceMetrics(tp, initialMetricsCount)
+	}
+}
+
+//PodRecord ... metrics accounted for a pod, used to revert them once the pod changes or goes away
+type PodRecord struct {
+	// ConfigTypes is the sorted, comma joined list of config types
+	ConfigTypes string
+	Namespace   string
+	// Node is the node the pod was accounted on
+	Node string
+	// Networks counts attachments per network attachment definition key (namespace/name)
+	Networks map[string]int
+	// MissingNetworks are the referenced network attachment definition keys which do not exist
+	MissingNetworks []string
+	// HasStatus is set once the pod network status is known, the fields below are empty without it
+	HasStatus bool
+	// Interfaces is the number of interfaces in the network status, the default network included
+	Interfaces int
+	// NotAttached counts requested attachments missing from the network status per network attachment definition key
+	NotAttached map[string]int
+	// IPs are the addresses in the network status per network attachment definition key
+	IPs map[string][]string
+}
+
+//ObjStore ... concurrency-safe store of the metrics accounted for each pod key
+type ObjStore struct {
+	lock  sync.RWMutex
+	store map[string]PodRecord
+}
+
+//NewObjStore ... returns an empty store
+func NewObjStore() *ObjStore {
+	return &ObjStore{
+		store: make(map[string]PodRecord, metricStoreInitSize), // Preallocate room 110 entires per node*3
 	}
 }
+
+//GetStoredRecord ... Get stored record for pod key
+func (o *ObjStore) GetStoredRecord(key string) (PodRecord, bool) {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+	value, ok := o.store[key]
+	return value, ok
+}
+
+//SetStoredRecord ... set stored record for pod key
+func (o *ObjStore) SetStoredRecord(key string, val PodRecord) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.store[key] = val
+}
+
+//DeleteStoredRecord ... remove stored record for pod key
+func (o *ObjStore) DeleteStoredRecord(key string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	delete(o.store, key)
+}
+
+//Records ... copy of all stored records by pod key
+func (o *ObjStore) Records() map[string]PodRecord {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+	records := make(map[string]PodRecord, len(o.store))
+	for key, val := range o.store {
+		records[key] = val
+	}
+	return records
+}
+
+//Len ... number of stored pod keys
+func (o *ObjStore) Len() int {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+	return len(o.store)
+}
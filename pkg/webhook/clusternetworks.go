@@ -0,0 +1,266 @@
+// Copyright (c) 2022 Network Plumbing Working Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Actions on net-attach-defs overlapping the cluster networks
+const (
+	// OverlapDeny denies net-attach-defs overlapping the cluster networks
+	OverlapDeny = "deny"
+	// OverlapWarn allows them with a warning to the client
+	OverlapWarn = "warn"
+)
+
+// clusterNetwork is a network of the cluster a net-attach-def must not overlap
+type clusterNetwork struct {
+	name  string
+	ipNet *net.IPNet
+	// address tells the network is the single address of a node, which only overlaps
+	// the IPAM networks allocating it
+	address bool
+}
+
+// clusterNetworkConfig are the cluster networks and the action on overlaps, set with
+// SetClusterNetworks
+type clusterNetworkConfig struct {
+	action string
+	// static are the networks configured
+	static []clusterNetwork
+	// nodeLister discovers the pod networks and addresses of the nodes, if set
+	nodeLister corelisters.NodeLister
+}
+
+var (
+	// clusterNetworks is nil until SetClusterNetworks is called, no overlap is checked without
+	clusterNetworks *clusterNetworkConfig
+)
+
+// SetClusterNetworks makes the webhook deny, or warn about, net-attach-defs whose subnets
+// and routes overlap the pod and service CIDRs
+func SetClusterNetworks(podCIDRs, serviceCIDRs []string, action string) error {
+	if action != OverlapDeny && action != OverlapWarn {
+		return fmt.Errorf("invalid action on cluster network overlaps %q, must be %s or %s", action, OverlapDeny, OverlapWarn)
+	}
+	config := &clusterNetworkConfig{action: action}
+	for _, cidrs := range []struct {
+		name  string
+		cidrs []string
+	}{{"pod network", podCIDRs}, {"service network", serviceCIDRs}} {
+		for _, cidr := range cidrs.cidrs {
+			_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+			if err != nil {
+				return fmt.Errorf("invalid %s %q: %v", cidrs.name, cidr, err)
+			}
+			config.static = append(config.static, clusterNetwork{name: cidrs.name, ipNet: ipNet})
+		}
+	}
+	clusterNetworks = config
+	return nil
+}
+
+// StartNodeInformer discovers the pod CIDRs and the internal addresses of the nodes
+// as cluster networks, SetupInClusterClient and SetClusterNetworks must be called first.
+// It returns once the cache is synced
+func StartNodeInformer(stopCh <-chan struct{}) error {
+	if clusterNetworks == nil {
+		return fmt.Errorf("cluster networks are not set")
+	}
+	factory := informers.NewSharedInformerFactory(clientset, 0)
+	informer := factory.Core().V1().Nodes()
+	lister := informer.Lister()
+	factory.Start(stopCh)
+	if !cache.WaitForCacheSync(stopCh, informer.Informer().HasSynced) {
+		return fmt.Errorf("failed to sync node cache")
+	}
+	clusterNetworks.nodeLister = lister
+	return nil
+}
+
+// networks returns the configured networks and those of the nodes
+func (c *clusterNetworkConfig) networks() []clusterNetwork {
+	// copy the configured networks, the config is shared by concurrent requests
+	networks := append([]clusterNetwork(nil), c.static...)
+	if c.nodeLister == nil {
+		return networks
+	}
+	nodes, err := c.nodeLister.List(labels.Everything())
+	if err != nil {
+		glog.Errorf("failed to list nodes: %v", err)
+		return networks
+	}
+	for _, node := range nodes {
+		for _, cidr := range node.Spec.PodCIDRs {
+			if _, ipNet, err := net.ParseCIDR(cidr); err == nil {
+				networks = append(networks, clusterNetwork{name: "pod network of node " + node.Name, ipNet: ipNet})
+			}
+		}
+		for _, address := range node.Status.Addresses {
+			if address.Type != v1.NodeInternalIP {
+				continue
+			}
+			if ip := net.ParseIP(address.Address); ip != nil {
+				bits := 8 * net.IPv6len
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 8*net.IPv4len
+				}
+				networks = append(networks, clusterNetwork{name: "address of node " + node.Name,
+					ipNet: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, address: true})
+			}
+		}
+	}
+	return networks
+}
+
+// overlaps tells whether the networks share addresses, i.e. one contains the other
+func overlaps(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// ipamNetwork is a subnet, range or route destination of an IPAM section
+type ipamNetwork struct {
+	path  *field.Path
+	ipNet *net.IPNet
+	// start and end bound the addresses allocated in the subnet, if the IPAM section
+	// restricts them
+	start, end net.IP
+}
+
+// allocates tells whether the IPAM network may hand out the address: any address of
+// its subnet, or only those between its start and end
+func (n ipamNetwork) allocates(ip net.IP) bool {
+	if !n.ipNet.Contains(ip) {
+		return false
+	}
+	if n.start != nil && bytes.Compare(ip.To16(), n.start.To16()) < 0 {
+		return false
+	}
+	return n.end == nil || bytes.Compare(ip.To16(), n.end.To16()) <= 0
+}
+
+// ipamNetworks returns the subnets, ranges and route destinations of the IPAM section of
+// the plugin configuration. Default routes are left out, they overlap everything
+func ipamNetworks(plugin pluginConfig) []ipamNetwork {
+	var networks []ipamNetwork
+	ipam, ok := plugin.conf["ipam"].(map[string]interface{})
+	if !ok {
+		return networks
+	}
+	ipamPath := plugin.path.Child("ipam")
+	parseIP := func(v interface{}) net.IP {
+		s, _ := v.(string)
+		return net.ParseIP(strings.TrimSpace(s))
+	}
+	// start and end are the fields restricting the allocated addresses, if any
+	add := func(v interface{}, fldPath *field.Path, start, end interface{}) {
+		s, _ := v.(string)
+		var first net.IP
+		if i := strings.Index(s, "-"); i >= 0 {
+			// whereabouts ranges may start with the first address
+			first = net.ParseIP(s[:i])
+			s = s[i+1:]
+		}
+		if ip := parseIP(start); ip != nil {
+			first = ip
+		}
+		if _, ipNet, err := net.ParseCIDR(s); err == nil {
+			if ones, _ := ipNet.Mask.Size(); ones > 0 {
+				networks = append(networks, ipamNetwork{path: fldPath, ipNet: ipNet, start: first, end: parseIP(end)})
+			}
+		}
+	}
+	objects := func(v interface{}) []map[string]interface{} {
+		var objs []map[string]interface{}
+		list, _ := v.([]interface{})
+		for _, item := range list {
+			obj, _ := item.(map[string]interface{})
+			objs = append(objs, obj)
+		}
+		return objs
+	}
+
+	add(ipam["subnet"], ipamPath.Child("subnet"), ipam["rangeStart"], ipam["rangeEnd"])
+	add(ipam["range"], ipamPath.Child("range"), ipam["range_start"], ipam["range_end"])
+	sets, _ := ipam["ranges"].([]interface{})
+	for i, set := range sets {
+		for j, r := range objects(set) {
+			add(r["subnet"], ipamPath.Child("ranges").Index(i).Index(j).Child("subnet"), r["rangeStart"], r["rangeEnd"])
+		}
+	}
+	for i, r := range objects(ipam["ipRanges"]) {
+		add(r["range"], ipamPath.Child("ipRanges").Index(i).Child("range"), r["range_start"], r["range_end"])
+	}
+	for i, r := range objects(ipam["routes"]) {
+		add(r["dst"], ipamPath.Child("routes").Index(i).Child("dst"), nil, nil)
+	}
+	return networks
+}
+
+// clusterNetworkOverlaps returns an error for each subnet, range or route of the plugin
+// configurations, including the delegates, overlapping a cluster network
+func clusterNetworkOverlaps(plugins []pluginConfig) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if clusterNetworks == nil {
+		return allErrs
+	}
+	networks := clusterNetworks.networks()
+	for _, plugin := range withDelegates(plugins) {
+		for _, ipamNet := range ipamNetworks(plugin) {
+			for _, network := range networks {
+				// node addresses outside of the allocated range are not handed out to pods
+				if network.address && !ipamNet.allocates(network.ipNet.IP) {
+					continue
+				}
+				if overlaps(ipamNet.ipNet, network.ipNet) {
+					allErrs = append(allErrs, field.Forbidden(ipamNet.path,
+						fmt.Sprintf("%s overlaps the %s %s", ipamNet.ipNet, network.name, network.ipNet)))
+					break
+				}
+			}
+		}
+	}
+	return allErrs
+}
+
+// validateClusterNetworkOverlaps denies the overlaps with the cluster networks, unless
+// they are only warned about
+func validateClusterNetworkOverlaps(plugins []pluginConfig) field.ErrorList {
+	if clusterNetworks == nil || clusterNetworks.action != OverlapDeny {
+		return field.ErrorList{}
+	}
+	return clusterNetworkOverlaps(plugins)
+}
+
+// networkOverlapWarnings returns the overlaps with the cluster networks of the plugin
+// configurations, if they are only warned about
+func networkOverlapWarnings(plugins []pluginConfig) field.ErrorList {
+	if clusterNetworks == nil || clusterNetworks.action != OverlapWarn {
+		return field.ErrorList{}
+	}
+	return clusterNetworkOverlaps(plugins)
+}
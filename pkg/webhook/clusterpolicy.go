@@ -0,0 +1,237 @@
+// Copyright (c) 2022 Network Plumbing Working Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/golang/glog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// Policy is the cluster network policy of the webhook, loaded from a YAML or JSON file.
+// Its rules are scoped to namespaces
+type Policy struct {
+	// PluginTypes restrict the CNI plugin types of net-attach-defs
+	PluginTypes []PluginTypeRule `json:"pluginTypes,omitempty"`
+	// Interfaces restrict the host interfaces net-attach-defs attach to
+	Interfaces []InterfaceRule `json:"interfaces,omitempty"`
+	// VLANs restrict the VLAN IDs net-attach-defs attach to
+	VLANs []VLANRule `json:"vlans,omitempty"`
+}
+
+// PolicyScope selects the namespaces a rule applies to, by name or labels. An
+// empty scope applies to all namespaces
+type PolicyScope struct {
+	Namespaces        []string              `json:"namespaces,omitempty"`
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+
+	selector labels.Selector
+}
+
+// PluginTypeRule allows or denies plugin types in the namespaces of its scope. A
+// type must be in the allowed list, if any, and must not be in the denied list
+type PluginTypeRule struct {
+	PolicyScope `json:",inline"`
+	Allowed     []string `json:"allowed,omitempty"`
+	Denied      []string `json:"denied,omitempty"`
+}
+
+// InterfaceRule allows or forbids host interfaces in the namespaces of its scope,
+// given as globs such as ens*f1. An interface must match an allowed glob, if any,
+// and must not match a forbidden one
+type InterfaceRule struct {
+	PolicyScope `json:",inline"`
+	Allowed     []string `json:"allowed,omitempty"`
+	Forbidden   []string `json:"forbidden,omitempty"`
+}
+
+// VLANRule restricts the VLAN IDs in the namespaces of its scope to ranges such as
+// 100-199, or single IDs
+type VLANRule struct {
+	PolicyScope `json:",inline"`
+	Ranges      []string `json:"ranges"`
+
+	ranges []vlanRange
+}
+
+// allows tells whether the VLAN is in one of the ranges of the rule
+func (r *VLANRule) allows(vlan int) bool {
+	for _, vr := range r.ranges {
+		if vr.contains(vlan) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	// clusterPolicy is the policy loaded with LoadPolicy, nil without one
+	clusterPolicy *Policy
+)
+
+// LoadPolicy loads the cluster network policy from the file, and enforces it
+// from then on
+func LoadPolicy(policyPath string) error {
+	file, err := os.Open(policyPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	policy := &Policy{}
+	if err := utilyaml.NewYAMLOrJSONDecoder(file, 4096).Decode(policy); err != nil {
+		return fmt.Errorf("failed to decode policy %s: %v", policyPath, err)
+	}
+	if err := policy.compile(); err != nil {
+		return fmt.Errorf("invalid policy %s: %v", policyPath, err)
+	}
+	clusterPolicy = policy
+	glog.Infof("loaded network policy from %s", policyPath)
+	return nil
+}
+
+// compile checks the rules of the policy and prepares their scopes
+func (p *Policy) compile() error {
+	for i := range p.PluginTypes {
+		rule := &p.PluginTypes[i]
+		if len(rule.Allowed) == 0 && len(rule.Denied) == 0 {
+			return fmt.Errorf("pluginTypes[%d]: must allow or deny plugin types", i)
+		}
+		if err := rule.PolicyScope.compile(); err != nil {
+			return fmt.Errorf("pluginTypes[%d]: %v", i, err)
+		}
+	}
+	for i := range p.Interfaces {
+		rule := &p.Interfaces[i]
+		if len(rule.Allowed) == 0 && len(rule.Forbidden) == 0 {
+			return fmt.Errorf("interfaces[%d]: must allow or forbid interfaces", i)
+		}
+		for _, pattern := range append(append([]string{}, rule.Allowed...), rule.Forbidden...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("interfaces[%d]: invalid glob %q: %v", i, pattern, err)
+			}
+		}
+		if err := rule.PolicyScope.compile(); err != nil {
+			return fmt.Errorf("interfaces[%d]: %v", i, err)
+		}
+	}
+	for i := range p.VLANs {
+		rule := &p.VLANs[i]
+		if len(rule.Ranges) == 0 {
+			return fmt.Errorf("vlans[%d]: must have VLAN ranges", i)
+		}
+		for _, r := range rule.Ranges {
+			vr, err := parseVLANRange(r)
+			if err != nil {
+				return fmt.Errorf("vlans[%d]: %v", i, err)
+			}
+			rule.ranges = append(rule.ranges, vr)
+		}
+		if err := rule.PolicyScope.compile(); err != nil {
+			return fmt.Errorf("vlans[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+func (s *PolicyScope) compile() error {
+	if s.NamespaceSelector == nil {
+		return nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(s.NamespaceSelector)
+	if err != nil {
+		return fmt.Errorf("invalid namespace selector: %v", err)
+	}
+	s.selector = selector
+	return nil
+}
+
+// matches tells whether the named namespace is in the scope
+func (s *PolicyScope) matches(namespace string) bool {
+	if len(s.Namespaces) == 0 && s.selector == nil {
+		return true
+	}
+	for _, name := range s.Namespaces {
+		if name == namespace {
+			return true
+		}
+	}
+	if s.selector == nil || namespace == "" {
+		return false
+	}
+	nsLabels, err := NamespaceLabels(namespace)
+	if err != nil {
+		glog.Warningf("cannot match namespace %s against policy selector: %v", namespace, err)
+		return false
+	}
+	return s.selector.Matches(labels.Set(nsLabels))
+}
+
+// pluginTypeRules returns the plugin type rules applying to the namespace
+func pluginTypeRules(namespace string) []PluginTypeRule {
+	if clusterPolicy == nil {
+		return nil
+	}
+	var rules []PluginTypeRule
+	for _, rule := range clusterPolicy.PluginTypes {
+		if rule.matches(namespace) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// interfaceRules returns the interface rules applying to the namespace
+func interfaceRules(namespace string) []InterfaceRule {
+	if clusterPolicy == nil {
+		return nil
+	}
+	var rules []InterfaceRule
+	for _, rule := range clusterPolicy.Interfaces {
+		if rule.matches(namespace) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// vlanRules returns the VLAN rules applying to the namespace
+func vlanRules(namespace string) []VLANRule {
+	if clusterPolicy == nil {
+		return nil
+	}
+	var rules []VLANRule
+	for _, rule := range clusterPolicy.VLANs {
+		if rule.matches(namespace) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// matchesGlob tells whether the name matches one of the globs
+func matchesGlob(globs []string, name string) bool {
+	for _, glob := range globs {
+		if matched, _ := path.Match(glob, name); matched {
+			return true
+		}
+	}
+	return false
+}
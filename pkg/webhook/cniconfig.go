@@ -0,0 +1,317 @@
+// Copyright (c) 2022 Network Plumbing Working Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// Actions on net-attach-defs with invalid IPAM sections
+const (
+	// IPAMDeny denies net-attach-defs with invalid IPAM sections
+	IPAMDeny = "deny"
+	// IPAMWarn allows them with a warning to the client
+	IPAMWarn = "warn"
+)
+
+var (
+	// ipamAction is the action on invalid IPAM sections, set with SetIPAMValidation
+	ipamAction = IPAMWarn
+)
+
+// SetIPAMValidation makes the webhook deny, or only warn about, net-attach-defs whose IPAM
+// sections have malformed subnets, addresses or routes
+func SetIPAMValidation(action string) error {
+	if action != IPAMDeny && action != IPAMWarn {
+		return fmt.Errorf("invalid action on invalid IPAM sections %q, must be %s or %s", action, IPAMDeny, IPAMWarn)
+	}
+	ipamAction = action
+	return nil
+}
+
+// pluginConfig is a plugin configuration of a CNI config and its path
+type pluginConfig struct {
+	conf map[string]interface{}
+	path *field.Path
+}
+
+// pluginConfigs returns the plugin configurations of a CNI config or config list, with
+// the errors of the list structure itself
+func pluginConfigs(c map[string]interface{}, fldPath *field.Path) ([]pluginConfig, field.ErrorList) {
+	p, ok := c["plugins"]
+	if !ok {
+		// single CNI config
+		return []pluginConfig{{conf: c, path: fldPath}}, nil
+	}
+
+	// CNI conflist
+	allErrs := field.ErrorList{}
+	pluginsPath := fldPath.Child("plugins")
+	plugins, ok := p.([]interface{})
+	if !ok {
+		return nil, append(allErrs, field.Invalid(pluginsPath, p, "must be a list of plugin configurations"))
+	}
+	if len(plugins) == 0 {
+		return nil, append(allErrs, field.Required(pluginsPath, "must have at least one plugin configuration"))
+	}
+	var configs []pluginConfig
+	for i, v := range plugins {
+		plugin, ok := v.(map[string]interface{})
+		if !ok {
+			allErrs = append(allErrs, field.Invalid(pluginsPath.Index(i), v, "must be a plugin configuration object"))
+			continue
+		}
+		configs = append(configs, pluginConfig{conf: plugin, path: pluginsPath.Index(i)})
+	}
+	return configs, allErrs
+}
+
+// withDelegates returns the plugin configurations with the configurations they delegate
+// to, nested at any depth: the "delegate" object of flannel and the "delegates" list of
+// multus. A flannel delegate without type is a bridge
+func withDelegates(plugins []pluginConfig) []pluginConfig {
+	var all []pluginConfig
+	for _, plugin := range plugins {
+		all = append(all, plugin)
+		var delegates []pluginConfig
+		if d, ok := plugin.conf["delegate"].(map[string]interface{}); ok {
+			if _, ok := d["type"]; !ok && plugin.conf["type"] == "flannel" {
+				d = copyWithType(d, "bridge")
+			}
+			delegates = append(delegates, pluginConfig{conf: d, path: plugin.path.Child("delegate")})
+		}
+		if list, ok := plugin.conf["delegates"].([]interface{}); ok {
+			for i, v := range list {
+				if d, ok := v.(map[string]interface{}); ok {
+					delegates = append(delegates, pluginConfig{conf: d, path: plugin.path.Child("delegates").Index(i)})
+				}
+			}
+		}
+		all = append(all, withDelegates(delegates)...)
+	}
+	return all
+}
+
+// copyWithType returns a copy of the plugin configuration with the type set
+func copyWithType(conf map[string]interface{}, pluginType string) map[string]interface{} {
+	c := make(map[string]interface{}, len(conf)+1)
+	for k, v := range conf {
+		c[k] = v
+	}
+	c["type"] = pluginType
+	return c
+}
+
+// validatePluginType checks the plugin configuration has a type
+func validatePluginType(plugin pluginConfig) field.ErrorList {
+	allErrs := field.ErrorList{}
+	t, ok := plugin.conf["type"]
+	if !ok {
+		return append(allErrs, field.Required(plugin.path.Child("type"), "missing 'type' in cni config"))
+	}
+	if s, ok := t.(string); !ok || s == "" {
+		allErrs = append(allErrs, field.Invalid(plugin.path.Child("type"), t, "must be a non-empty string"))
+	}
+	return allErrs
+}
+
+// ipamWarnings returns the problems of the IPAM sections of the plugin configurations, if
+// they are only warned about
+func ipamWarnings(plugins []pluginConfig) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if ipamAction != IPAMWarn {
+		return allErrs
+	}
+	for _, plugin := range plugins {
+		allErrs = append(allErrs, validateIPAM(plugin)...)
+	}
+	return allErrs
+}
+
+// validateIPAM checks the addresses, subnets and routes of the IPAM section of the plugin
+// configuration, in the formats of the host-local and whereabouts plugins
+func validateIPAM(plugin pluginConfig) field.ErrorList {
+	allErrs := field.ErrorList{}
+	v, ok := plugin.conf["ipam"]
+	if !ok {
+		return allErrs
+	}
+	ipamPath := plugin.path.Child("ipam")
+	ipam, ok := v.(map[string]interface{})
+	if !ok {
+		return append(allErrs, field.Invalid(ipamPath, v, "must be an IPAM configuration object"))
+	}
+	if len(ipam) == 0 {
+		// an empty IPAM section is allowed by plugins which do not need one
+		return allErrs
+	}
+	if t, ok := ipam["type"].(string); !ok || t == "" {
+		allErrs = append(allErrs, field.Required(ipamPath.Child("type"), "missing 'type' in ipam config"))
+	}
+
+	// host-local
+	allErrs = append(allErrs, validateIPRange(ipam, ipamPath, "subnet", "rangeStart", "rangeEnd", "gateway")...)
+	if ranges, ok := ipam["ranges"]; ok {
+		sets, ok := ranges.([]interface{})
+		if !ok {
+			allErrs = append(allErrs, field.Invalid(ipamPath.Child("ranges"), ranges, "must be a list of range sets"))
+		}
+		for i, set := range sets {
+			setPath := ipamPath.Child("ranges").Index(i)
+			rangeSet, ok := set.([]interface{})
+			if !ok {
+				allErrs = append(allErrs, field.Invalid(setPath, set, "must be a list of ranges"))
+				continue
+			}
+			for j, r := range rangeSet {
+				allErrs = append(allErrs, validateIPRangeObject(r, setPath.Index(j), "subnet", "rangeStart", "rangeEnd", "gateway")...)
+			}
+		}
+	}
+
+	// whereabouts
+	allErrs = append(allErrs, validateIPRange(ipam, ipamPath, "range", "range_start", "range_end", "")...)
+	allErrs = append(allErrs, validateCIDRList(ipam, ipamPath, "exclude")...)
+	if ipRanges, ok := ipam["ipRanges"]; ok {
+		list, ok := ipRanges.([]interface{})
+		if !ok {
+			allErrs = append(allErrs, field.Invalid(ipamPath.Child("ipRanges"), ipRanges, "must be a list of ranges"))
+		}
+		for i, r := range list {
+			rangePath := ipamPath.Child("ipRanges").Index(i)
+			allErrs = append(allErrs, validateIPRangeObject(r, rangePath, "range", "range_start", "range_end", "")...)
+			if obj, ok := r.(map[string]interface{}); ok {
+				allErrs = append(allErrs, validateCIDRList(obj, rangePath, "exclude")...)
+			}
+		}
+	}
+
+	allErrs = append(allErrs, validateRoutes(ipam, ipamPath)...)
+	return allErrs
+}
+
+// validateIPRangeObject checks a range object of a list of ranges
+func validateIPRangeObject(v interface{}, fldPath *field.Path, subnetKey, startKey, endKey, gatewayKey string) field.ErrorList {
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return field.ErrorList{field.Invalid(fldPath, v, "must be a range object")}
+	}
+	allErrs := validateIPRange(obj, fldPath, subnetKey, startKey, endKey, gatewayKey)
+	if _, ok := obj[subnetKey]; !ok {
+		allErrs = append(allErrs, field.Required(fldPath.Child(subnetKey), ""))
+	}
+	return allErrs
+}
+
+// validateIPRange checks the subnet of a range is a CIDR and its start, end and gateway
+// are addresses of the subnet
+func validateIPRange(obj map[string]interface{}, fldPath *field.Path, subnetKey, startKey, endKey, gatewayKey string) field.ErrorList {
+	allErrs := field.ErrorList{}
+	var subnet *net.IPNet
+	if v, ok := obj[subnetKey]; ok {
+		s, _ := v.(string)
+		if i := strings.Index(s, "-"); i >= 0 && subnetKey == "range" {
+			// whereabouts also takes the first address of the range in front of the CIDR
+			if net.ParseIP(s[:i]) == nil {
+				allErrs = append(allErrs, field.Invalid(fldPath.Child(subnetKey), v, "must be a CIDR, optionally preceded by the first address and a dash"))
+			}
+			s = s[i+1:]
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child(subnetKey), v, "must be a CIDR, e.g. 192.168.1.0/24"))
+		} else {
+			subnet = ipNet
+		}
+	}
+	for _, key := range []string{startKey, endKey, gatewayKey} {
+		if key == "" {
+			continue
+		}
+		v, ok := obj[key]
+		if !ok {
+			continue
+		}
+		s, _ := v.(string)
+		ip := net.ParseIP(s)
+		if ip == nil {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child(key), v, "must be an IP address"))
+		} else if subnet != nil && !subnet.Contains(ip) {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child(key), v, "must be in "+subnetKey+" "+subnet.String()))
+		}
+	}
+	return allErrs
+}
+
+// validateCIDRList checks the field is a list of CIDRs
+func validateCIDRList(obj map[string]interface{}, fldPath *field.Path, key string) field.ErrorList {
+	allErrs := field.ErrorList{}
+	v, ok := obj[key]
+	if !ok {
+		return allErrs
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return append(allErrs, field.Invalid(fldPath.Child(key), v, "must be a list of CIDRs"))
+	}
+	for i, item := range list {
+		if s, _ := item.(string); !isCIDR(s) {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child(key).Index(i), item, "must be a CIDR"))
+		}
+	}
+	return allErrs
+}
+
+// validateRoutes checks the destinations and gateways of the IPAM routes
+func validateRoutes(ipam map[string]interface{}, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	v, ok := ipam["routes"]
+	if !ok {
+		return allErrs
+	}
+	routesPath := fldPath.Child("routes")
+	routes, ok := v.([]interface{})
+	if !ok {
+		return append(allErrs, field.Invalid(routesPath, v, "must be a list of routes"))
+	}
+	for i, r := range routes {
+		routePath := routesPath.Index(i)
+		route, ok := r.(map[string]interface{})
+		if !ok {
+			allErrs = append(allErrs, field.Invalid(routePath, r, "must be a route object"))
+			continue
+		}
+		if dst, ok := route["dst"]; !ok {
+			allErrs = append(allErrs, field.Required(routePath.Child("dst"), ""))
+		} else if s, _ := dst.(string); !isCIDR(s) {
+			allErrs = append(allErrs, field.Invalid(routePath.Child("dst"), dst, "must be a CIDR"))
+		}
+		if gw, ok := route["gw"]; ok {
+			if s, _ := gw.(string); net.ParseIP(s) == nil {
+				allErrs = append(allErrs, field.Invalid(routePath.Child("gw"), gw, "must be an IP address"))
+			}
+		}
+	}
+	return allErrs
+}
+
+func isCIDR(s string) bool {
+	_, _, err := net.ParseCIDR(s)
+	return err == nil
+}
@@ -0,0 +1,234 @@
+// Copyright (c) 2022 Network Plumbing Working Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/api/admission/v1beta1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// DecisionLogStdout is the decision log path writing to the standard output
+	DecisionLogStdout = "-"
+	// decisionLogBuffer is the number of decisions queued before new ones are dropped
+	decisionLogBuffer = 1024
+
+	verdictAllowed = "allowed"
+	verdictDenied  = "denied"
+	verdictError   = "error"
+)
+
+var (
+	// decisions logs the admission decisions when enabled with EnableDecisionLog
+	decisions *decisionLogger
+)
+
+// decision is a line of the decision log
+type decision struct {
+	Time      time.Time    `json:"time"`
+	UID       k8stypes.UID `json:"uid"`
+	Kind      string       `json:"kind"`
+	Namespace string       `json:"namespace,omitempty"`
+	Name      string       `json:"name,omitempty"`
+	Operation string       `json:"operation"`
+	User      string       `json:"user"`
+	Verdict   string       `json:"verdict"`
+	Rules     []string     `json:"rules,omitempty"`
+	Message   string       `json:"message,omitempty"`
+	Latency   float64      `json:"latencySeconds"`
+}
+
+// decisionLogger writes decisions as JSON lines from its own goroutine, so a slow
+// or failing output never delays the admission responses
+type decisionLogger struct {
+	entries chan decision
+	out     io.Writer
+	dropped uint64
+}
+
+// EnableDecisionLog makes the webhook log every admission decision as a JSON line to the
+// file at path, rotated when it reaches maxSize bytes with maxBackups old files kept,
+// or to the standard output when path is DecisionLogStdout
+func EnableDecisionLog(path string, maxSize int64, maxBackups int) error {
+	var out io.Writer = os.Stdout
+	if path != DecisionLogStdout {
+		file, err := newRotatingFile(path, maxSize, maxBackups)
+		if err != nil {
+			return err
+		}
+		out = file
+	}
+	decisions = newDecisionLogger(out, decisionLogBuffer)
+	return nil
+}
+
+func newDecisionLogger(out io.Writer, buffer int) *decisionLogger {
+	l := &decisionLogger{
+		entries: make(chan decision, buffer),
+		out:     out,
+	}
+	go l.run()
+	return l
+}
+
+func (l *decisionLogger) run() {
+	for entry := range l.entries {
+		if dropped := atomic.SwapUint64(&l.dropped, 0); dropped > 0 {
+			glog.Warningf("decision log dropped %d decisions, the output is too slow", dropped)
+		}
+		line, err := json.Marshal(entry)
+		if err != nil {
+			glog.Errorf("failed to marshal decision of request %s: %v", entry.UID, err)
+			continue
+		}
+		if _, err := l.out.Write(append(line, '\n')); err != nil {
+			glog.Errorf("failed to write decision log: %v", err)
+		}
+	}
+}
+
+// log queues the decision, or drops it when the queue is full
+func (l *decisionLogger) log(entry decision) {
+	select {
+	case l.entries <- entry:
+	default:
+		atomic.AddUint64(&l.dropped, 1)
+	}
+}
+
+// logDecision logs the decision taken on the admission review, if the decision log is enabled
+// and the request is not a dry run
+func logDecision(ar *v1beta1.AdmissionReview, start time.Time) {
+	if decisions == nil || ar == nil || ar.Request == nil || isDryRun(ar) {
+		return
+	}
+	req := ar.Request
+	entry := decision{
+		Time:      start.UTC(),
+		UID:       req.UID,
+		Kind:      req.Kind.Kind,
+		Namespace: req.Namespace,
+		Name:      req.Name,
+		Operation: string(req.Operation),
+		User:      req.UserInfo.Username,
+		Verdict:   verdictError,
+		Latency:   time.Since(start).Seconds(),
+	}
+	if resp := ar.Response; resp != nil {
+		entry.Verdict = verdictAllowed
+		if !resp.Allowed {
+			entry.Verdict = verdictDenied
+		}
+		if rules, ok := resp.AuditAnnotations[auditAnnotationRule]; ok {
+			entry.Rules = strings.Split(rules, ",")
+		}
+		if resp.Result != nil {
+			entry.Message = resp.Result.Message
+		}
+	}
+	decisions.log(entry)
+}
+
+// rotatingFile is a file renamed to <path>.1 and reopened once it reaches its maximum
+// size, with the older files shifted up to <path>.<maxBackups>
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func newRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("invalid decision log size %d", maxSize)
+	}
+	f := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// Write is only called from the decision logger goroutine
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	if f.file == nil {
+		// the file could not be reopened on the last rotation
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			glog.Errorf("failed to rotate decision log %s: %v", f.path, err)
+			if f.file == nil {
+				return 0, err
+			}
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate moves the file to its first backup and reopens the path. The path is reopened
+// even if the file could not be moved, the decisions are then appended to it
+func (f *rotatingFile) rotate() error {
+	err := f.file.Close()
+	f.file = nil
+	if err == nil {
+		err = f.shift()
+	}
+	if openErr := f.open(); openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+// shift renames the file and its backups to the next backup, or removes the file
+// without backups
+func (f *rotatingFile) shift() error {
+	if f.maxBackups == 0 {
+		return os.Remove(f.path)
+	}
+	for i := f.maxBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	return os.Rename(f.path, f.path+".1")
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2022 Network Plumbing Working Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"strings"
+
+	"github.com/golang/glog"
+	"gopkg.in/k8snetworkplumbingwg/multus-cni.v3/pkg/types"
+	"k8s.io/api/admission/v1beta1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// Keys of the audit annotations set on denied requests, the API server prefixes
+// them with the name of the webhook in its audit log
+const (
+	auditAnnotationRule         = "rule"
+	auditAnnotationNetwork      = "network"
+	auditAnnotationNetAttachDef = "net-attach-def"
+
+	netAttachDefKind = "NetworkAttachmentDefinition"
+)
+
+var (
+	// recorder records denial events when enabled with EnableDenialEvents
+	recorder record.EventRecorder
+)
+
+// EnableDenialEvents makes the webhook record an event on the namespace of the denied
+// requests, SetupInClusterClient must be called first
+func EnableDenialEvents() {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartLogging(glog.Infof)
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	recorder = broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: "net-attach-def-admission-controller"})
+}
+
+// networkReference formats a network selection element the way the networks annotation refers to it
+func networkReference(network *types.NetworkSelectionElement) string {
+	reference := network.Name
+	if network.Namespace != namespaceConstraint {
+		reference = network.Namespace + "/" + reference
+	}
+	if network.InterfaceRequest != "" {
+		reference += "@" + network.InterfaceRequest
+	}
+	return reference
+}
+
+// prepareDenialResponse denies the request with the validation error as message and
+// the rule it violates in the audit annotations
+func prepareDenialResponse(ar *v1beta1.AdmissionReview, err error) error {
+	if prepErr := prepareAdmissionReviewResponse(false, err.Error(), ar); prepErr != nil {
+		return prepErr
+	}
+	ar.Response.AuditAnnotations = denialAuditAnnotations(ar, err)
+	return nil
+}
+
+// denialAuditAnnotations returns the audit annotations explaining why the request was denied,
+// the values list the rules, networks and net-attach-defs of all the errors separated by commas
+func denialAuditAnnotations(ar *v1beta1.AdmissionReview, err error) map[string]string {
+	var rules, networks, netAttachDefs []string
+	for _, re := range ruleErrorsOf(err) {
+		rules = appendUnique(rules, re.rule)
+		networks = appendUnique(networks, re.network)
+		netAttachDefs = appendUnique(netAttachDefs, re.netAttachDef)
+	}
+	if len(netAttachDefs) == 0 && ar.Request.Kind.Kind == netAttachDefKind {
+		netAttachDefs = []string{ar.Request.Namespace + "/" + ar.Request.Name}
+	}
+
+	annotations := make(map[string]string)
+	for key, values := range map[string][]string{
+		auditAnnotationRule:         rules,
+		auditAnnotationNetwork:      networks,
+		auditAnnotationNetAttachDef: netAttachDefs,
+	} {
+		if len(values) > 0 {
+			annotations[key] = strings.Join(values, ",")
+		}
+	}
+	if len(annotations) == 0 {
+		return nil
+	}
+	return annotations
+}
+
+// appendUnique appends the value if not empty nor in the list already
+func appendUnique(list []string, value string) []string {
+	if value == "" {
+		return list
+	}
+	for _, v := range list {
+		if v == value {
+			return list
+		}
+	}
+	return append(list, value)
+}
+
+// recordDenialEvent records the denial on the namespace of the request, if enabled
+func recordDenialEvent(ar *v1beta1.AdmissionReview, err error) {
+	if recorder == nil || ar.Request.Namespace == "" {
+		return
+	}
+	namespace := &v1.ObjectReference{
+		Kind:       "Namespace",
+		APIVersion: "v1",
+		Name:       ar.Request.Namespace,
+		// keep the event in the namespace so its users see it
+		Namespace: ar.Request.Namespace,
+	}
+	recorder.Eventf(namespace, v1.EventTypeWarning, "AdmissionDenied", "Denied %s of %s %s: %v",
+		ar.Request.Operation, ar.Request.Kind.Kind, ar.Request.Name, err)
+}
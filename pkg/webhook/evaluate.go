@@ -0,0 +1,350 @@
+// Copyright (c) 2022 Network Plumbing Working Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/k8snetworkplumbingwg/net-attach-def-admission-controller/pkg/exemption"
+	netv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	"github.com/pkg/errors"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+)
+
+const (
+	// RuleMissingNetwork warns about pods referring to net-attach-defs which do not exist
+	RuleMissingNetwork = "missing-network"
+	// ruleInvalidObject fails the evaluation of objects which cannot be decoded
+	ruleInvalidObject = "invalid-object"
+
+	resultPass = "pass"
+	resultFail = "fail"
+	resultWarn = "warn"
+	// resultSkip is the result of the rules which could not be evaluated as a rule they depend on failed
+	resultSkip = "skip"
+)
+
+// ruleSpec is a rule evaluated on an object, the field it checks and the rule
+// which must pass for it to be evaluated
+type ruleSpec struct {
+	rule      string
+	field     string
+	dependsOn string
+}
+
+var (
+	// netAttachDefRules are the rules of the /validate webhook
+	netAttachDefRules = []ruleSpec{
+		{rule: RuleInvalidName, field: "metadata.name"},
+		{rule: RuleConfigNotJSON, field: "spec.config"},
+		{rule: RuleInvalidConfig, field: "spec.config", dependsOn: RuleConfigNotJSON},
+		{rule: RuleInvalidIPAM, field: "spec.config", dependsOn: RuleConfigNotJSON},
+		{rule: RuleDisallowedPluginType, field: "spec.config", dependsOn: RuleConfigNotJSON},
+		{rule: RuleForbiddenInterface, field: "spec.config", dependsOn: RuleConfigNotJSON},
+		{rule: RuleInvalidVLAN, field: "spec.config", dependsOn: RuleConfigNotJSON},
+		{rule: RuleForbiddenVLAN, field: "spec.config", dependsOn: RuleInvalidVLAN},
+		{rule: RuleVLANConflict, field: "spec.config", dependsOn: RuleInvalidVLAN},
+		{rule: RuleClusterNetworkOverlap, field: "spec.config", dependsOn: RuleInvalidIPAM},
+		{rule: RuleNetAttachDefQuota, field: "metadata.namespace"},
+	}
+	// podRules are the rules of the /isolate webhook
+	podRules = []ruleSpec{
+		{rule: RuleInvalidNetworksAnnotation, field: networksAnnotationPath.String()},
+		{rule: RuleCrossNamespaceNetwork, field: networksAnnotationPath.String(), dependsOn: RuleInvalidNetworksAnnotation},
+		{rule: RuleAttachmentQuota, field: networksAnnotationPath.String(), dependsOn: RuleInvalidNetworksAnnotation},
+		{rule: RulePodQuota, field: networksAnnotationPath.String(), dependsOn: RuleInvalidNetworksAnnotation},
+	}
+)
+
+// RuleResult is the outcome of a rule in an evaluation report
+type RuleResult struct {
+	Rule    string `json:"rule"`
+	Result  string `json:"result"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// EvaluationReport is the response of the /evaluate endpoint, Allowed tells whether
+// the webhooks would admit the object. Exempt objects are allowed whatever the results
+// of the rules, Exemption is the reason of the exemption
+type EvaluationReport struct {
+	Kind      string       `json:"kind"`
+	Namespace string       `json:"namespace"`
+	Name      string       `json:"name"`
+	Allowed   bool         `json:"allowed"`
+	Exemption string       `json:"exemption,omitempty"`
+	Results   []RuleResult `json:"results"`
+}
+
+// evaluationObject is the part of the evaluated object identifying it
+type evaluationObject struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+}
+
+// ruleResults reports a failure per violation of the rules, with the path of the offending
+// field, a warning per violation only warned about, and the rules depending on a failed
+// rule as skipped
+func ruleResults(rules []ruleSpec, err error, warnings ruleErrors) ([]RuleResult, bool) {
+	results := make([]RuleResult, 0, len(rules))
+	violations := map[string][]Violation{}
+	undecodable := false
+	if err != nil {
+		for _, violation := range violationsOf(err) {
+			if violation.Rule == "" {
+				// not a rule violation, the object could not be decoded
+				results = append(results, RuleResult{Rule: ruleInvalidObject, Result: resultFail, Message: violation.Message})
+				undecodable = true
+				continue
+			}
+			violations[violation.Rule] = append(violations[violation.Rule], violation)
+		}
+	}
+	warned := map[string][]Violation{}
+	for _, violation := range violationsOf(warnings) {
+		warned[violation.Rule] = append(warned[violation.Rule], violation)
+	}
+
+	failed := map[string]bool{}
+	for _, spec := range rules {
+		switch {
+		case undecodable || failed[spec.dependsOn]:
+			results = append(results, RuleResult{Rule: spec.rule, Result: resultSkip, Field: spec.field})
+			failed[spec.rule] = true
+		case len(violations[spec.rule]) > 0:
+			for _, violation := range violations[spec.rule] {
+				fieldPath := violation.Field
+				if fieldPath == "" {
+					fieldPath = spec.field
+				}
+				results = append(results, RuleResult{Rule: spec.rule, Result: resultFail, Field: fieldPath, Message: violation.Message})
+			}
+			failed[spec.rule] = true
+		case len(warned[spec.rule]) > 0:
+			for _, violation := range warned[spec.rule] {
+				results = append(results, RuleResult{Rule: spec.rule, Result: resultWarn, Field: violation.Field, Message: violation.Message})
+			}
+		default:
+			results = append(results, RuleResult{Rule: spec.rule, Result: resultPass, Field: spec.field})
+		}
+	}
+	return results, err == nil
+}
+
+// evaluateNetworkAttachmentDefinition evaluates the /validate rules on the net-attach-def,
+// as a creation counting against the quota of the namespace
+func evaluateNetworkAttachmentDefinition(raw []byte, report *EvaluationReport) {
+	netAttachDef := netv1.NetworkAttachmentDefinition{}
+	err := json.Unmarshal(raw, &netAttachDef)
+	if err == nil {
+		netAttachDef.Namespace = report.Namespace
+		_, err = validateNetworkAttachmentDefinition(netAttachDef)
+		if quotaErrs := validateNetAttachDefQuota(netAttachDef); len(quotaErrs) > 0 {
+			err = ruleErrorsOf(err).add(RuleNetAttachDefQuota, quotaErrs)
+		}
+	}
+	report.Results, report.Allowed = ruleResults(netAttachDefRules, err, netAttachDefWarnings(netAttachDef))
+}
+
+// evaluatePod evaluates the /isolate rules on the pod, as a creation counting against the
+// quotas, and warns about the networks it refers to which do not exist in the cluster
+func evaluatePod(raw []byte, report *EvaluationReport) {
+	pod := v1.Pod{}
+	err := json.Unmarshal(raw, &pod)
+	reviewErr := err
+	if err == nil {
+		pod.Namespace = report.Namespace
+		err = analyzePodIsolation(pod)
+		reviewErr = err
+		if quotaErr := validatePodQuotas(pod); quotaErr != nil {
+			reviewErr = append(ruleErrorsOf(err), ruleErrorsOf(quotaErr)...)
+		}
+	}
+	report.Results, report.Allowed = ruleResults(podRules, reviewErr, nil)
+
+	if nadClientset == nil || err != nil || pod.Annotations[networksAnnotationKey] == "" {
+		return
+	}
+	networks, err := parsePodNetworkAnnotation(pod.Annotations[networksAnnotationKey], report.Namespace)
+	if err != nil {
+		return
+	}
+	result := RuleResult{Rule: RuleMissingNetwork, Result: resultPass, Field: networksAnnotationPath.String()}
+	var missing []string
+	for _, network := range networks {
+		_, err := nadClientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions(network.Namespace).Get(context.TODO(), network.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			missing = append(missing, network.Namespace+"/"+network.Name)
+		} else if err != nil {
+			glog.Errorf("failed to get net-attach-def %s/%s: %v", network.Namespace, network.Name, err)
+		}
+	}
+	if len(missing) > 0 {
+		result.Result = resultWarn
+		result.Message = fmt.Sprintf("network attachment definitions do not exist: %v", missing)
+	}
+	report.Results = append(report.Results, result)
+}
+
+// evaluate reports the rules of the webhooks on a net-attach-def or pod, nothing is persisted
+func evaluate(raw []byte, defaultNamespace string) (*EvaluationReport, error) {
+	var object evaluationObject
+	if err := json.Unmarshal(raw, &object); err != nil {
+		return nil, errors.Wrap(err, "error decoding object")
+	}
+	report := &EvaluationReport{
+		Kind:      object.Kind,
+		Namespace: object.Namespace,
+		Name:      object.Name,
+	}
+	if report.Namespace == "" {
+		report.Namespace = defaultNamespace
+	}
+
+	switch object.Kind {
+	case netAttachDefKind:
+		evaluateNetworkAttachmentDefinition(raw, report)
+	case podKind:
+		evaluatePod(raw, report)
+	default:
+		return nil, errors.Errorf("unsupported kind %q, expected %s or %s", object.Kind, netAttachDefKind, podKind)
+	}
+	return report, nil
+}
+
+// authorizeEvaluation authenticates the bearer token of the request with a TokenReview, and
+// checks with a SubjectAccessReview that the user may create the object, since the report
+// reveals the policy of the namespace. It returns the user, or the HTTP status of the failure
+func authorizeEvaluation(req *http.Request, kind, namespace string) (authenticationv1.UserInfo, int, error) {
+	user := authenticationv1.UserInfo{}
+	if clientset == nil {
+		return user, http.StatusServiceUnavailable, errors.New("evaluations cannot be authorized without a cluster client")
+	}
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if token == "" || token == req.Header.Get("Authorization") {
+		return user, http.StatusUnauthorized, errors.New("a bearer token is required")
+	}
+	tokenReview, err := clientset.AuthenticationV1().TokenReviews().Create(context.TODO(),
+		&authenticationv1.TokenReview{Spec: authenticationv1.TokenReviewSpec{Token: token}}, metav1.CreateOptions{})
+	if err != nil {
+		return user, http.StatusInternalServerError, errors.Wrap(err, "failed to review token")
+	}
+	if !tokenReview.Status.Authenticated {
+		return user, http.StatusUnauthorized, errors.New("invalid bearer token")
+	}
+	user = tokenReview.Status.User
+
+	resource := &authorizationv1.ResourceAttributes{Namespace: namespace, Verb: "create", Resource: "pods"}
+	if kind == netAttachDefKind {
+		resource.Group, resource.Resource = netv1.SchemeGroupVersion.Group, "network-attachment-definitions"
+	}
+	extra := map[string]authorizationv1.ExtraValue{}
+	for key, value := range user.Extra {
+		extra[key] = authorizationv1.ExtraValue(value)
+	}
+	accessReview, err := clientset.AuthorizationV1().SubjectAccessReviews().Create(context.TODO(),
+		&authorizationv1.SubjectAccessReview{Spec: authorizationv1.SubjectAccessReviewSpec{
+			ResourceAttributes: resource,
+			User:               user.Username,
+			Groups:             user.Groups,
+			UID:                user.UID,
+			Extra:              extra,
+		}}, metav1.CreateOptions{})
+	if err != nil {
+		return user, http.StatusInternalServerError, errors.Wrap(err, "failed to review access")
+	}
+	if !accessReview.Status.Allowed {
+		return user, http.StatusForbidden, errors.Errorf("user %s may not create %s in namespace %s", user.Username, resource.Resource, namespace)
+	}
+	return user, http.StatusOK, nil
+}
+
+// EvaluateHandler reports how the webhooks would handle the NetworkAttachmentDefinition or
+// Pod object of the request, in JSON or YAML, without persisting anything. The namespace
+// query parameter sets the namespace of objects without one. The requests are authorized
+// as the creation of the object by the user of their bearer token, whose exemptions apply.
+func EvaluateHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil || len(body) == 0 {
+		http.Error(w, "Error reading HTTP request: empty body", http.StatusBadRequest)
+		return
+	}
+	raw, err := utilyaml.ToJSON(body)
+	if err != nil {
+		http.Error(w, errors.Wrap(err, "error decoding object").Error(), http.StatusBadRequest)
+		return
+	}
+
+	var object evaluationObject
+	if err := json.Unmarshal(raw, &object); err != nil {
+		http.Error(w, errors.Wrap(err, "error decoding object").Error(), http.StatusBadRequest)
+		return
+	}
+	if object.Kind != netAttachDefKind && object.Kind != podKind {
+		http.Error(w, fmt.Sprintf("unsupported kind %q, expected %s or %s", object.Kind, netAttachDefKind, podKind), http.StatusBadRequest)
+		return
+	}
+	namespace := object.Namespace
+	if namespace == "" {
+		namespace = req.URL.Query().Get("namespace")
+	}
+	if namespace == "" {
+		namespace = metav1.NamespaceDefault
+	}
+	user, status, err := authorizeEvaluation(req, object.Kind, namespace)
+	if err != nil {
+		glog.Infof("evaluation of %s %s/%s refused: %v", object.Kind, namespace, object.Name, err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	report, err := evaluate(raw, namespace)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	report.Exemption = exemptions.Reason(exemption.Subject{
+		Namespace: namespace,
+		User:      user.Username,
+		Groups:    user.Groups,
+		Labels:    object.Labels,
+	})
+	if report.Exemption != "" {
+		report.Allowed = true
+	}
+
+	resp, err := json.Marshal(report)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
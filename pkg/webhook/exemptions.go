@@ -0,0 +1,87 @@
+// Copyright (c) 2022 Network Plumbing Working Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/golang/glog"
+	"github.com/k8snetworkplumbingwg/net-attach-def-admission-controller/pkg/exemption"
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Names of the handlers in exemption logs and metrics
+const (
+	componentValidate = "validate"
+	componentIsolate  = "isolate"
+
+	// auditAnnotationExemption is the audit annotation set on exempt requests
+	auditAnnotationExemption = "exemption"
+)
+
+var (
+	// exemptions are the requests allowed without checks, set with SetExemptions
+	exemptions *exemption.Exemptions
+)
+
+// SetExemptions makes the handlers allow the requests exempt from enforcement
+func SetExemptions(e *exemption.Exemptions) {
+	exemptions = e
+}
+
+// requestSubject returns what exemptions are checked against for the request,
+// the labels are taken from the old object on delete
+func requestSubject(ar *v1beta1.AdmissionReview) exemption.Subject {
+	subject := exemption.Subject{
+		Namespace: ar.Request.Namespace,
+		User:      ar.Request.UserInfo.Username,
+		Groups:    ar.Request.UserInfo.Groups,
+	}
+	raw := ar.Request.Object.Raw
+	if len(raw) == 0 {
+		raw = ar.Request.OldObject.Raw
+	}
+	var object metav1.PartialObjectMetadata
+	if len(raw) > 0 && json.Unmarshal(raw, &object) == nil {
+		subject.Labels = object.Labels
+	}
+	return subject
+}
+
+// allowExempt allows the request and writes the response if it is exempt from
+// enforcement by the component, it returns whether it did
+func allowExempt(w http.ResponseWriter, ar *v1beta1.AdmissionReview, component string) bool {
+	if exemptions == nil || ar.Request == nil {
+		return false
+	}
+	subject := requestSubject(ar)
+	description := fmt.Sprintf("%s of %s %s/%s by %s", ar.Request.Operation, ar.Request.Kind.Kind,
+		ar.Request.Namespace, ar.Request.Name, subject.User)
+	reason := exemptions.Exempt(component, description, subject)
+	if reason == "" {
+		return false
+	}
+	if err := prepareAdmissionReviewResponse(true, "", ar); err != nil {
+		glog.Error(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return true
+	}
+	ar.Response.AuditAnnotations = map[string]string{auditAnnotationExemption: reason}
+	writeResponse(w, ar)
+	return true
+}
@@ -0,0 +1,169 @@
+// Copyright (c) 2022 Network Plumbing Working Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	netv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/client-go/tools/cache"
+)
+
+var (
+	// nadCache caches the net-attach-defs of the cluster once
+	// WatchNetworkAttachmentDefinitions is called, nil before
+	nadCache *netAttachDefCache
+)
+
+// vlanKey identifies a VLAN on a master
+type vlanKey struct {
+	master string
+	vlan   int
+}
+
+// netAttachDefCache keeps track of the VLANs claimed by the cached net-attach-defs
+type netAttachDefCache struct {
+	// indexer holds the net-attach-defs by namespace, nil until synced
+	indexer cache.Indexer
+
+	lock sync.RWMutex
+	// vlans are the keys of the net-attach-defs claiming each VLAN
+	vlans map[vlanKey]map[string]bool
+	// netAttachDefVLANs are the VLANs claimed by each net-attach-def
+	netAttachDefVLANs map[string][]vlanKey
+}
+
+func newNetAttachDefCache() *netAttachDefCache {
+	return &netAttachDefCache{
+		vlans:             make(map[vlanKey]map[string]bool),
+		netAttachDefVLANs: make(map[string][]vlanKey),
+	}
+}
+
+// WatchNetworkAttachmentDefinitions caches the net-attach-defs of the informer for the
+// handlers. The informer must index them by namespace, it is shared with the controller
+// and started by its owner. It returns once the cache is synced
+func WatchNetworkAttachmentDefinitions(informer cache.SharedIndexInformer, stopCh <-chan struct{}) error {
+	c := newNetAttachDefCache()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if nad, ok := obj.(*netv1.NetworkAttachmentDefinition); ok {
+				c.update(nad)
+			}
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			if nad, ok := obj.(*netv1.NetworkAttachmentDefinition); ok {
+				c.update(nad)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj); err == nil {
+				c.remove(key)
+			}
+		},
+	})
+	if !cache.WaitForCacheSync(stopCh, informer.HasSynced) {
+		return fmt.Errorf("failed to sync net-attach-def cache")
+	}
+	// handlers are called asynchronously, the synced store may be ahead of them
+	for _, obj := range informer.GetStore().List() {
+		if nad, ok := obj.(*netv1.NetworkAttachmentDefinition); ok {
+			c.update(nad)
+		}
+	}
+	c.indexer = informer.GetIndexer()
+	nadCache = c
+	return nil
+}
+
+// update records the VLANs claimed by the net-attach-def, replacing those of its previous version
+func (c *netAttachDefCache) update(nad *netv1.NetworkAttachmentDefinition) {
+	key := nad.Namespace + "/" + nad.Name
+	var keys []vlanKey
+	var conf map[string]interface{}
+	if err := json.Unmarshal([]byte(nad.Spec.Config), &conf); err == nil {
+		plugins, _ := pluginConfigs(conf, field.NewPath("spec", "config"))
+		claims, _ := vlanClaims(plugins, nad.GetAnnotations()[networkResourceNameKey])
+		for _, claim := range claims {
+			if claim.master != "" {
+				keys = append(keys, vlanKey{master: claim.master, vlan: claim.vlan})
+			}
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.removeLocked(key)
+	for _, k := range keys {
+		if c.vlans[k] == nil {
+			c.vlans[k] = make(map[string]bool)
+		}
+		c.vlans[k][key] = true
+	}
+	if len(keys) > 0 {
+		c.netAttachDefVLANs[key] = keys
+	}
+}
+
+// remove forgets the VLANs claimed by the net-attach-def of the key
+func (c *netAttachDefCache) remove(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.removeLocked(key)
+}
+
+func (c *netAttachDefCache) removeLocked(key string) {
+	for _, k := range c.netAttachDefVLANs[key] {
+		delete(c.vlans[k], key)
+		if len(c.vlans[k]) == 0 {
+			delete(c.vlans, k)
+		}
+	}
+	delete(c.netAttachDefVLANs, key)
+}
+
+// vlanOwners returns the keys of the net-attach-defs of other namespaces than the given
+// one which claim the VLAN on the master, none without cache
+func (c *netAttachDefCache) vlanOwners(master string, vlan int, namespace string) []string {
+	if c == nil {
+		return nil
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	var owners []string
+	for key := range c.vlans[vlanKey{master: master, vlan: vlan}] {
+		if !strings.HasPrefix(key, namespace+"/") {
+			owners = append(owners, key)
+		}
+	}
+	return owners
+}
+
+// count returns the number of cached net-attach-defs of the namespace, and whether
+// they are cached
+func (c *netAttachDefCache) count(namespace string) (int, bool) {
+	if c == nil || c.indexer == nil {
+		return 0, false
+	}
+	objs, err := c.indexer.ByIndex(cache.NamespaceIndex, namespace)
+	if err != nil {
+		return 0, false
+	}
+	return len(objs), true
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2022 Network Plumbing Working Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"context"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+var (
+	// namespaceLister caches the namespaces once StartNamespaceInformer is called
+	namespaceLister corelisters.NamespaceLister
+)
+
+// StartNamespaceInformer caches the namespaces of the cluster for the handlers,
+// SetupInClusterClient must be called first. It returns once the cache is synced
+func StartNamespaceInformer(stopCh <-chan struct{}) error {
+	factory := informers.NewSharedInformerFactory(clientset, 0)
+	informer := factory.Core().V1().Namespaces()
+	lister := informer.Lister()
+	factory.Start(stopCh)
+	if !cache.WaitForCacheSync(stopCh, informer.Informer().HasSynced) {
+		return fmt.Errorf("failed to sync namespace cache")
+	}
+	namespaceLister = lister
+	return nil
+}
+
+// getNamespace returns the namespace from the cache, or from the API server
+// when the namespace informer is not running
+func getNamespace(name string) (*v1.Namespace, error) {
+	if namespaceLister != nil {
+		return namespaceLister.Get(name)
+	}
+	if clientset == nil {
+		return nil, fmt.Errorf("no client to get namespace %s", name)
+	}
+	return clientset.CoreV1().Namespaces().Get(context.TODO(), name, metav1.GetOptions{})
+}
+
+// NamespaceLabels returns the labels of the named namespace
+func NamespaceLabels(name string) (map[string]string, error) {
+	namespace, err := getNamespace(name)
+	if err != nil {
+		return nil, err
+	}
+	return namespace.Labels, nil
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2022 Network Plumbing Working Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// Keys of the namespace annotations, or labels, choosing the policy of the namespace
+const (
+	isolationKey          = "netattach.k8s.cni.cncf.io/isolation"
+	allowedPluginTypesKey = "netattach.k8s.cni.cncf.io/allowed-plugin-types"
+	// keys overriding the quotas of the namespace
+	maxNetAttachDefsKey       = "netattach.k8s.cni.cncf.io/max-net-attach-defs"
+	maxAttachmentsPerPodKey   = "netattach.k8s.cni.cncf.io/max-attachments-per-pod"
+	maxPodsPerNetAttachDefKey = "netattach.k8s.cni.cncf.io/max-pods-per-net-attach-def"
+)
+
+// Isolation levels of a namespace
+const (
+	// IsolationStrict only lets pods attach net-attach-defs of their own namespace, the default
+	IsolationStrict = "strict"
+	// IsolationShared also lets pods of other namespaces attach the net-attach-defs of the namespace
+	IsolationShared = "shared"
+)
+
+// namespacePolicy is the policy a namespace chose through its annotations or labels
+type namespacePolicy struct {
+	isolation string
+	// allowedPluginTypes restricts the plugin types of the net-attach-defs of
+	// the namespace, empty allows all types
+	allowedPluginTypes []string
+	// quotas are the quotas of the webhook, unless the namespace overrides them
+	quotas Quotas
+}
+
+// defaultNamespacePolicy applies to namespaces without policy, or which cannot be found
+var defaultNamespacePolicy = namespacePolicy{isolation: IsolationStrict}
+
+// namespacePolicyOf returns the policy of the named namespace. Annotations take
+// precedence over labels, which cannot hold lists
+func namespacePolicyOf(name string) namespacePolicy {
+	policy := defaultNamespacePolicy
+	policy.quotas = quotas
+	if name == "" {
+		return policy
+	}
+	namespace, err := getNamespace(name)
+	if err != nil {
+		glog.V(4).Infof("using the default policy for namespace %s: %v", name, err)
+		return policy
+	}
+	value := func(key string) string {
+		if v, ok := namespace.Annotations[key]; ok {
+			return v
+		}
+		return namespace.Labels[key]
+	}
+
+	switch isolation := value(isolationKey); isolation {
+	case "":
+	case IsolationStrict, IsolationShared:
+		policy.isolation = isolation
+	default:
+		glog.Warningf("ignoring invalid %s %q of namespace %s", isolationKey, isolation, name)
+	}
+	for _, t := range strings.Split(value(allowedPluginTypesKey), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			policy.allowedPluginTypes = append(policy.allowedPluginTypes, t)
+		}
+	}
+	for key, quota := range map[string]*int{
+		maxNetAttachDefsKey:       &policy.quotas.NetAttachDefsPerNamespace,
+		maxAttachmentsPerPodKey:   &policy.quotas.AttachmentsPerPod,
+		maxPodsPerNetAttachDefKey: &policy.quotas.PodsPerNetAttachDef,
+	} {
+		v := value(key)
+		if v == "" {
+			continue
+		}
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			*quota = n
+		} else {
+			glog.Warningf("ignoring invalid %s %q of namespace %s", key, v, name)
+		}
+	}
+	return policy
+}
+
+// validatePluginTypes checks the plugin types of the net-attach-def config, including
+// the delegates, are allowed in its namespace by the namespace policy and by the
+// rules of the cluster policy
+func validatePluginTypes(namespace string, plugins []pluginConfig) field.ErrorList {
+	allErrs := field.ErrorList{}
+	nsPolicy := namespacePolicyOf(namespace)
+	rules := pluginTypeRules(namespace)
+	for _, plugin := range withDelegates(plugins) {
+		t, ok := plugin.conf["type"].(string)
+		if !ok {
+			continue
+		}
+		typePath := plugin.path.Child("type")
+		if len(nsPolicy.allowedPluginTypes) > 0 && !containsString(nsPolicy.allowedPluginTypes, t) {
+			allErrs = append(allErrs, field.NotSupported(typePath, t, nsPolicy.allowedPluginTypes))
+			continue
+		}
+		for _, rule := range rules {
+			if containsString(rule.Denied, t) {
+				allErrs = append(allErrs, field.Forbidden(typePath,
+					fmt.Sprintf("plugin type %q is denied in namespace %s", t, namespace)))
+				break
+			}
+			if len(rule.Allowed) > 0 && !containsString(rule.Allowed, t) {
+				allErrs = append(allErrs, field.NotSupported(typePath, t, rule.Allowed))
+				break
+			}
+		}
+	}
+	return allErrs
+}
+
+// interfaceFields are the fields of plugin configurations naming the host interface
+// they attach to: the master of macvlan, ipvlan and vlan, the device and PCI address
+// of host-device, and the bridge of bridge and ovs
+var interfaceFields = []string{"master", "device", "pciBusID", "bridge"}
+
+// validateInterfaces checks the host interfaces the net-attach-def config, including
+// the delegates, attaches to are allowed in its namespace by the cluster policy
+func validateInterfaces(namespace string, plugins []pluginConfig) field.ErrorList {
+	allErrs := field.ErrorList{}
+	rules := interfaceRules(namespace)
+	if len(rules) == 0 {
+		return allErrs
+	}
+	for _, plugin := range withDelegates(plugins) {
+		for _, key := range interfaceFields {
+			name, ok := plugin.conf[key].(string)
+			if !ok || name == "" {
+				continue
+			}
+			for _, rule := range rules {
+				if matchesGlob(rule.Forbidden, name) {
+					allErrs = append(allErrs, field.Forbidden(plugin.path.Child(key),
+						fmt.Sprintf("host interface %q is forbidden in namespace %s", name, namespace)))
+					break
+				}
+				if len(rule.Allowed) > 0 && !matchesGlob(rule.Allowed, name) {
+					allErrs = append(allErrs, field.Forbidden(plugin.path.Child(key),
+						fmt.Sprintf("host interface %q is not allowed in namespace %s, allowed: %s", name, namespace, strings.Join(rule.Allowed, ", "))))
+					break
+				}
+			}
+		}
+	}
+	return allErrs
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
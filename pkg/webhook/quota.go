@@ -0,0 +1,134 @@
+// Copyright (c) 2022 Network Plumbing Working Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"fmt"
+	"sync"
+
+	netv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// Quotas limit the net-attach-defs and network attachments of tenants on admission,
+// zero leaves a limit out. They are counted from caches, so they are eventually
+// consistent: concurrent creations may exceed them by a few
+type Quotas struct {
+	// NetAttachDefsPerNamespace is the maximum number of net-attach-defs of a namespace
+	NetAttachDefsPerNamespace int
+	// AttachmentsPerPod is the maximum number of networks in the networks annotation of a pod
+	AttachmentsPerPod int
+	// PodsPerNetAttachDef is the maximum number of admitted, non-terminal pods attached to a net-attach-def
+	PodsPerNetAttachDef int
+}
+
+// PodCounter returns the number of admitted, non-terminal pods attached to the
+// net-attach-def of the key (namespace/name)
+type PodCounter func(netAttachDefKey string) int
+
+var (
+	// quotas are the limits of the namespaces which do not override them
+	quotas Quotas
+
+	podCounterLock sync.RWMutex
+	// podCounter is set once a pod cache is synced, the pods per net-attach-def are
+	// not limited before
+	podCounter PodCounter
+)
+
+// SetQuotas sets the limits enforced in the namespaces which do not override them
+func SetQuotas(q Quotas) error {
+	if q.NetAttachDefsPerNamespace < 0 || q.AttachmentsPerPod < 0 || q.PodsPerNetAttachDef < 0 {
+		return fmt.Errorf("quotas must not be negative")
+	}
+	quotas = q
+	return nil
+}
+
+// SetPodCounter makes the webhook count the pods attached to net-attach-defs with the
+// counter, nil stops limiting the pods per net-attach-def
+func SetPodCounter(counter PodCounter) {
+	podCounterLock.Lock()
+	defer podCounterLock.Unlock()
+	podCounter = counter
+}
+
+// countPods returns the number of pods attached to the net-attach-def, and whether
+// they can be counted
+func countPods(netAttachDefKey string) (int, bool) {
+	podCounterLock.RLock()
+	defer podCounterLock.RUnlock()
+	if podCounter == nil {
+		return 0, false
+	}
+	return podCounter(netAttachDefKey), true
+}
+
+// validateNetAttachDefQuota checks the namespace of a new net-attach-def has room for it
+func validateNetAttachDefQuota(netAttachDef netv1.NetworkAttachmentDefinition) field.ErrorList {
+	allErrs := field.ErrorList{}
+	max := namespacePolicyOf(netAttachDef.Namespace).quotas.NetAttachDefsPerNamespace
+	if max == 0 {
+		return allErrs
+	}
+	count, ok := nadCache.count(netAttachDef.Namespace)
+	if ok && count >= max {
+		allErrs = append(allErrs, field.Forbidden(field.NewPath("metadata", "namespace"),
+			fmt.Sprintf("namespace %s already has %d net-attach-defs, the maximum is %d", netAttachDef.Namespace, count, max)))
+	}
+	return allErrs
+}
+
+// validatePodQuotas checks the number of networks the pod attaches to, and that the
+// net-attach-defs it attaches to have room for another pod
+func validatePodQuotas(pod v1.Pod) error {
+	networksAnnotation := pod.GetAnnotations()[networksAnnotationKey]
+	if networksAnnotation == "" {
+		return nil
+	}
+	networks, err := parsePodNetworkAnnotation(networksAnnotation, pod.Namespace)
+	if err != nil {
+		// reported by the isolation rules
+		return nil
+	}
+
+	allErrs := ruleErrors{}
+	podQuotas := namespacePolicyOf(pod.Namespace).quotas
+	if max := podQuotas.AttachmentsPerPod; max > 0 && len(networks) > max {
+		allErrs = allErrs.add(RuleAttachmentQuota, field.ErrorList{field.Forbidden(networksAnnotationPath,
+			fmt.Sprintf("pod attaches to %d networks, the maximum is %d", len(networks), max))})
+	}
+
+	// each net-attach-def is limited by the quota of its own namespace
+	counted := map[string]bool{}
+	for i, item := range networks {
+		key := item.Namespace + "/" + item.Name
+		if counted[key] {
+			continue
+		}
+		counted[key] = true
+		max := namespacePolicyOf(item.Namespace).quotas.PodsPerNetAttachDef
+		if max == 0 {
+			continue
+		}
+		if count, ok := countPods(key); ok && count >= max {
+			allErrs = append(allErrs, newNetworkRuleError(RulePodQuota, field.Forbidden(networksAnnotationPath.Index(i),
+				fmt.Sprintf("net-attach-def %s is already attached to %d pods, the maximum is %d", key, count, max)),
+				networkReference(item), key))
+		}
+	}
+	return allErrs.toError()
+}
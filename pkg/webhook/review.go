@@ -0,0 +1,59 @@
+// Copyright (c) 2022 Network Plumbing Working Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"k8s.io/api/admission/v1beta1"
+)
+
+const (
+	podKind = "Pod"
+)
+
+// Review answers the admission review the way the /validate webhook does for net-attach-defs
+// and the /isolate webhook does for pods, without recording events nor decisions. It fails
+// only when the review cannot be answered, a denial or warnings are set in its response.
+func Review(ar *v1beta1.AdmissionReview) error {
+	if ar.Request == nil {
+		return errors.New("received empty AdmissionReview request")
+	}
+	if len(ar.Request.Object.Raw) == 0 {
+		return errors.New("AdmissionReview request has no object")
+	}
+
+	var err error
+	switch ar.Request.Kind.Kind {
+	case netAttachDefKind:
+		_, err = reviewNetworkAttachmentDefinition(ar)
+	case podKind:
+		_, err = analyzeIsolationAnnotation(ar)
+	default:
+		return fmt.Errorf("unsupported kind %q, expected %s or %s", ar.Request.Kind.Kind, netAttachDefKind, podKind)
+	}
+
+	if err != nil {
+		return prepareDenialResponse(ar, err)
+	}
+	if err := prepareAdmissionReviewResponse(true, "", ar); err != nil {
+		return err
+	}
+	if ar.Request.Kind.Kind == netAttachDefKind {
+		addNetAttachDefWarnings(ar)
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2022 Network Plumbing Working Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"fmt"
+
+	netv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	v1 "k8s.io/api/core/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// Identifiers of the validation rules, reported by the audit and in its metrics
+const (
+	// RuleInvalidName is violated by net-attach-def names which are not DNS-1123 labels
+	RuleInvalidName = "invalid-name"
+	// RuleConfigNotJSON is violated by a spec.config which is not a JSON object
+	RuleConfigNotJSON = "config-not-json"
+	// RuleInvalidConfig is violated by a spec.config CNI would not accept
+	RuleInvalidConfig = "invalid-config"
+	// RuleInvalidIPAM is violated by IPAM sections with malformed subnets, addresses or routes
+	RuleInvalidIPAM = "invalid-ipam"
+	// RuleDisallowedPluginType is violated by plugin types the namespace of the net-attach-def does not allow
+	RuleDisallowedPluginType = "disallowed-plugin-type"
+	// RuleForbiddenInterface is violated by host interfaces the policy does not allow in the namespace of the net-attach-def
+	RuleForbiddenInterface = "forbidden-interface"
+	// RuleInvalidVLAN is violated by VLAN IDs which are not integers between 0 and 4094
+	RuleInvalidVLAN = "invalid-vlan"
+	// RuleForbiddenVLAN is violated by VLAN IDs out of the ranges the policy allows in the namespace of the net-attach-def
+	RuleForbiddenVLAN = "forbidden-vlan"
+	// RuleVLANConflict is violated by VLANs already claimed on the same master by a net-attach-def of another namespace
+	RuleVLANConflict = "vlan-conflict"
+	// RuleClusterNetworkOverlap is violated by subnets, ranges and routes overlapping the pod, service or node networks
+	RuleClusterNetworkOverlap = "cluster-network-overlap"
+	// RuleNetAttachDefQuota is violated by new net-attach-defs exceeding the maximum of their namespace
+	RuleNetAttachDefQuota = "net-attach-def-quota"
+	// RuleInvalidNetworksAnnotation is violated by pods with a networks annotation which does not parse
+	RuleInvalidNetworksAnnotation = "invalid-networks-annotation"
+	// RuleCrossNamespaceNetwork is violated by pods referring to net-attach-defs of other namespaces
+	// which the isolation of the namespaces does not allow
+	RuleCrossNamespaceNetwork = "cross-namespace-network"
+	// RuleAttachmentQuota is violated by new pods attaching to more networks than their namespace allows
+	RuleAttachmentQuota = "attachment-quota"
+	// RulePodQuota is violated by new pods attaching to a net-attach-def which already has the
+	// maximum number of pods of its namespace
+	RulePodQuota = "pod-quota"
+)
+
+var (
+	// networksAnnotationPath is the field path of the networks annotation of pods
+	networksAnnotationPath = field.NewPath("metadata", "annotations").Key(networksAnnotationKey)
+)
+
+// Violation is a validation rule broken by an object
+type Violation struct {
+	Rule    string `json:"rule"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// ruleError is a validation error tagged with the rule it violates and, when
+// the rule is about a network reference, the offending network
+type ruleError struct {
+	rule string
+	err  error
+	// network is the offending entry of the networks annotation
+	network string
+	// netAttachDef is the key of the net-attach-def the error is about
+	netAttachDef string
+}
+
+func (e *ruleError) Error() string {
+	if fieldErr, ok := e.err.(*field.Error); ok && fieldErr.Type == field.ErrorTypeInvalid && fieldErr.BadValue == nil {
+		// values too large to repeat, like a whole config, are left out of the message
+		return fmt.Sprintf("%s: %s", fieldErr.Field, fieldErr.Detail)
+	}
+	return e.err.Error()
+}
+
+func (e *ruleError) Cause() error {
+	return e.err
+}
+
+// field returns the path of the field the error is about, if known
+func (e *ruleError) field() string {
+	if fieldErr, ok := e.err.(*field.Error); ok {
+		return fieldErr.Field
+	}
+	return ""
+}
+
+func newRuleError(rule string, err error) error {
+	return &ruleError{rule: rule, err: err}
+}
+
+func newNetworkRuleError(rule string, err error, network, netAttachDef string) *ruleError {
+	return &ruleError{rule: rule, err: err, network: network, netAttachDef: netAttachDef}
+}
+
+// ruleErrors are all the rule errors found validating an object, reported at once
+type ruleErrors []*ruleError
+
+func (e ruleErrors) Error() string {
+	errs := make([]error, 0, len(e))
+	for _, re := range e {
+		errs = append(errs, re)
+	}
+	return utilerrors.NewAggregate(errs).Error()
+}
+
+// add tags the field errors with the rule they violate
+func (e ruleErrors) add(rule string, errs field.ErrorList) ruleErrors {
+	for _, err := range errs {
+		e = append(e, &ruleError{rule: rule, err: err})
+	}
+	return e
+}
+
+// toError returns nil when no error was found, so a nil ruleErrors is never returned as a non-nil error
+func (e ruleErrors) toError() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// violationsOf returns the violations reported by a validation error
+func violationsOf(err error) []Violation {
+	switch e := err.(type) {
+	case ruleErrors:
+		violations := make([]Violation, 0, len(e))
+		for _, re := range e {
+			violations = append(violations, violationsOf(re)...)
+		}
+		return violations
+	case *ruleError:
+		return []Violation{{Rule: e.rule, Field: e.field(), Message: e.Error()}}
+	}
+	return []Violation{{Message: err.Error()}}
+}
+
+// ruleErrorsOf returns the rule errors of a validation error
+func ruleErrorsOf(err error) ruleErrors {
+	switch e := err.(type) {
+	case ruleErrors:
+		return e
+	case *ruleError:
+		return ruleErrors{e}
+	}
+	return nil
+}
+
+// AuditNetworkAttachmentDefinition validates an existing net-attach-def with the rules
+// the webhook enforces on admission and returns the violations found
+func AuditNetworkAttachmentDefinition(netAttachDef netv1.NetworkAttachmentDefinition) []Violation {
+	if _, err := validateNetworkAttachmentDefinition(netAttachDef); err != nil {
+		return violationsOf(err)
+	}
+	return nil
+}
+
+// AuditPod checks the networks annotation of an existing pod with the isolation rules
+// the webhook enforces on admission and returns the violations found
+func AuditPod(pod v1.Pod) []Violation {
+	if err := analyzePodIsolation(pod); err != nil {
+		return violationsOf(err)
+	}
+	return nil
+}
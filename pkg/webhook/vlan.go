@@ -0,0 +1,223 @@
+// Copyright (c) 2022 Network Plumbing Working Group
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	netv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+const (
+	maxVLANID = 4094
+	// defaultBridge is the bridge of bridge plugin configurations without one
+	defaultBridge = "cni0"
+)
+
+// vlanClaim is a VLAN a plugin configuration attaches to on a host interface, bridge,
+// or SR-IOV resource. VLAN 0 is untagged and claims nothing
+type vlanClaim struct {
+	master string
+	vlan   int
+	path   *field.Path
+}
+
+// vlanRange is an inclusive range of VLAN IDs
+type vlanRange struct {
+	min, max int
+}
+
+func (r vlanRange) contains(vlan int) bool {
+	return r.min <= vlan && vlan <= r.max
+}
+
+// parseVLANRange parses a VLAN ID, or a range of them such as 100-199
+func parseVLANRange(s string) (vlanRange, error) {
+	bounds := strings.SplitN(strings.TrimSpace(s), "-", 2)
+	min, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+	if err != nil {
+		return vlanRange{}, fmt.Errorf("invalid VLAN range %q", s)
+	}
+	max := min
+	if len(bounds) == 2 {
+		if max, err = strconv.Atoi(strings.TrimSpace(bounds[1])); err != nil {
+			return vlanRange{}, fmt.Errorf("invalid VLAN range %q", s)
+		}
+	}
+	if min < 0 || max > maxVLANID || min > max {
+		return vlanRange{}, fmt.Errorf("invalid VLAN range %q, VLAN IDs are 0-%d", s, maxVLANID)
+	}
+	return vlanRange{min: min, max: max}, nil
+}
+
+// vlanID returns the VLAN ID of a JSON value, with the error of the field if it is not one
+func vlanID(v interface{}, fldPath *field.Path) (int, *field.Error) {
+	n, ok := v.(float64)
+	if !ok || n != float64(int(n)) {
+		return 0, field.Invalid(fldPath, v, "must be an integer VLAN ID")
+	}
+	if n < 0 || n > maxVLANID {
+		return 0, field.Invalid(fldPath, v, fmt.Sprintf("must be a VLAN ID between 0 and %d", maxVLANID))
+	}
+	return int(n), nil
+}
+
+// vlanClaims returns the VLANs the plugin configurations, including the delegates,
+// attach to, with the errors of the VLAN fields. The VLANs of vlan plugins and of
+// macvlan masters named after their VLAN, such as ens1f0.100, are on their master,
+// those of bridges on the bridge, and those of sriov on the resource of the net-attach-def
+func vlanClaims(plugins []pluginConfig, resourceName string) ([]vlanClaim, field.ErrorList) {
+	var claims []vlanClaim
+	allErrs := field.ErrorList{}
+	claim := func(master string, v interface{}, fldPath *field.Path) {
+		vlan, err := vlanID(v, fldPath)
+		if err != nil {
+			allErrs = append(allErrs, err)
+			return
+		}
+		if vlan != 0 {
+			claims = append(claims, vlanClaim{master: master, vlan: vlan, path: fldPath})
+		}
+	}
+
+	for _, plugin := range withDelegates(plugins) {
+		master, _ := plugin.conf["master"].(string)
+		switch plugin.conf["type"] {
+		case "vlan":
+			if v, ok := plugin.conf["vlanId"]; ok {
+				claim(master, v, plugin.path.Child("vlanId"))
+			}
+		case "macvlan":
+			if i := strings.LastIndex(master, "."); i > 0 {
+				if vlan, err := strconv.Atoi(master[i+1:]); err == nil {
+					claim(master[:i], float64(vlan), plugin.path.Child("master"))
+				}
+			}
+		case "bridge":
+			bridge, _ := plugin.conf["bridge"].(string)
+			if bridge == "" {
+				bridge = defaultBridge
+			}
+			if v, ok := plugin.conf["vlan"]; ok {
+				claim(bridge, v, plugin.path.Child("vlan"))
+			}
+			if v, ok := plugin.conf["vlanTrunk"]; ok {
+				trunkPath := plugin.path.Child("vlanTrunk")
+				trunk, ok := v.([]interface{})
+				if !ok {
+					allErrs = append(allErrs, field.Invalid(trunkPath, v, "must be a list of VLAN IDs or ranges"))
+					continue
+				}
+				for i, t := range trunk {
+					trunkClaims, errs := vlanTrunkClaims(bridge, t, trunkPath.Index(i))
+					claims = append(claims, trunkClaims...)
+					allErrs = append(allErrs, errs...)
+				}
+			}
+		case "sriov":
+			if v, ok := plugin.conf["vlan"]; ok {
+				claim(resourceName, v, plugin.path.Child("vlan"))
+			}
+		}
+	}
+	return claims, allErrs
+}
+
+// vlanTrunkClaims returns the VLANs of a vlanTrunk entry of a bridge, either {"id": N}
+// or {"minID": N, "maxID": M}
+func vlanTrunkClaims(bridge string, v interface{}, fldPath *field.Path) ([]vlanClaim, field.ErrorList) {
+	allErrs := field.ErrorList{}
+	entry, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, append(allErrs, field.Invalid(fldPath, v, "must be a VLAN ID or range object"))
+	}
+	var ids []int
+	for _, key := range []string{"id", "minID", "maxID"} {
+		if v, ok := entry[key]; ok {
+			vlan, err := vlanID(v, fldPath.Child(key))
+			if err != nil {
+				allErrs = append(allErrs, err)
+				continue
+			}
+			ids = append(ids, vlan)
+		}
+	}
+	if len(allErrs) > 0 {
+		return nil, allErrs
+	}
+
+	r := vlanRange{}
+	switch {
+	case len(ids) == 1 && entry["id"] != nil:
+		r = vlanRange{min: ids[0], max: ids[0]}
+	case len(ids) == 2 && entry["id"] == nil:
+		r = vlanRange{min: ids[0], max: ids[1]}
+		if r.min > r.max {
+			return nil, append(allErrs, field.Invalid(fldPath.Child("minID"), entry["minID"], "must not be greater than maxID"))
+		}
+	default:
+		return nil, append(allErrs, field.Invalid(fldPath, v, "must have either an id or both minID and maxID"))
+	}
+	var claims []vlanClaim
+	for vlan := r.min; vlan <= r.max; vlan++ {
+		if vlan != 0 {
+			claims = append(claims, vlanClaim{master: bridge, vlan: vlan, path: fldPath})
+		}
+	}
+	return claims, allErrs
+}
+
+// validateVLANs checks the VLAN IDs of the net-attach-def are valid and in the ranges
+// the policy allows in its namespace, and that no other namespace claims them on the
+// same master
+func validateVLANs(netAttachDef netv1.NetworkAttachmentDefinition, plugins []pluginConfig) ruleErrors {
+	claims, invalidErrs := vlanClaims(plugins, netAttachDef.GetAnnotations()[networkResourceNameKey])
+	allErrs := ruleErrors{}.add(RuleInvalidVLAN, invalidErrs)
+
+	// the VLANs of a trunk range share their path, one error per path is enough
+	rangeErrs := field.ErrorList{}
+	for _, rule := range vlanRules(netAttachDef.GetNamespace()) {
+		reported := map[*field.Path]bool{}
+		for _, c := range claims {
+			if !reported[c.path] && !rule.allows(c.vlan) {
+				reported[c.path] = true
+				rangeErrs = append(rangeErrs, field.Forbidden(c.path, fmt.Sprintf("VLAN %d is not allowed in namespace %s, allowed: %s",
+					c.vlan, netAttachDef.GetNamespace(), strings.Join(rule.Ranges, ", "))))
+			}
+		}
+	}
+	allErrs = allErrs.add(RuleForbiddenVLAN, rangeErrs)
+
+	conflictErrs := field.ErrorList{}
+	reported := map[*field.Path]bool{}
+	for _, c := range claims {
+		if c.master == "" || reported[c.path] {
+			continue
+		}
+		owners := nadCache.vlanOwners(c.master, c.vlan, netAttachDef.GetNamespace())
+		if len(owners) == 0 {
+			continue
+		}
+		sort.Strings(owners)
+		conflictErrs = append(conflictErrs, field.Forbidden(c.path, fmt.Sprintf("VLAN %d on %s is already claimed by %s",
+			c.vlan, c.master, strings.Join(owners, ", "))))
+		reported[c.path] = true
+	}
+	return allErrs.add(RuleVLANConflict, conflictErrs)
+}
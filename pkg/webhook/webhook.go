@@ -22,17 +22,20 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/containernetworking/cni/libcni"
 	"github.com/golang/glog"
 	"gopkg.in/k8snetworkplumbingwg/multus-cni.v3/pkg/types"
 	netv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	netattachdefClientset "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/client/clientset/versioned"
 	"github.com/pkg/errors"
 	"k8s.io/api/admission/v1beta1"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 )
@@ -50,36 +53,31 @@ const (
 )
 
 var (
-	clientset kubernetes.Interface
+	nadNameRegexp = regexp.MustCompile(`^[a-z-1-9]([-a-z0-9]*[a-z0-9])?$`)
+
+	clientset    kubernetes.Interface
+	nadClientset netattachdefClientset.Interface
 )
 
 // validateCNIConfig verifies following fields
-// conf: 'type'
-// conflist: 'plugins' and 'type'
-func validateCNIConfig(config []byte) error {
+// conf: 'type' and 'ipam', unless invalid IPAM sections are only warned about
+// conflist: 'plugins' and 'type' and 'ipam' of each plugin
+func validateCNIConfig(config []byte, fldPath *field.Path) ruleErrors {
 	var c map[string]interface{}
 	if err := json.Unmarshal(config, &c); err != nil {
-		return err
+		return ruleErrors{}.add(RuleConfigNotJSON, field.ErrorList{field.Invalid(fldPath, nil, err.Error())})
 	}
 
 	// Identify target is single CNI config or plugins
-	if p, ok := c["plugins"]; ok {
-		// CNI conflist
-		// check 'type' field for each plugin in 'plugins'
-		plugins := p.([]interface{})
-		for _, v := range plugins {
-			plugin := v.(map[string]interface{})
-			if _, ok := plugin["type"]; !ok {
-				return fmt.Errorf("missing 'type' in plugins")
-			}
-		}
-	} else {
-		// single CNI config
-		if _, ok := c["type"]; !ok {
-			return fmt.Errorf("missing 'type' in cni config")
+	plugins, listErrs := pluginConfigs(c, fldPath)
+	allErrs := ruleErrors{}.add(RuleInvalidConfig, listErrs)
+	for _, plugin := range plugins {
+		allErrs = allErrs.add(RuleInvalidConfig, validatePluginType(plugin))
+		if ipamAction == IPAMDeny {
+			allErrs = allErrs.add(RuleInvalidIPAM, validateIPAM(plugin))
 		}
 	}
-	return nil
+	return allErrs
 }
 
 // preprocessCNIConfig process CNI config bytes as following (that multus does too)
@@ -95,56 +93,51 @@ func preprocessCNIConfig(name string, config []byte) ([]byte, error) {
 	return configBytes, err
 }
 
-// isJSON detects if a string is in JSON format
-func isJSON(s string) bool {
-	var js map[string]interface{}
-	return json.Unmarshal([]byte(s), &js) == nil
-}
-
 func validateNetworkAttachmentDefinition(netAttachDef netv1.NetworkAttachmentDefinition) (bool, error) {
-	nameRegex := `^[a-z-1-9]([-a-z0-9]*[a-z0-9])?$`
-	isNameCorrect, err := regexp.MatchString(nameRegex, netAttachDef.GetName())
-	if !isNameCorrect {
-		err := errors.New("net-attach-def name is invalid")
-		glog.Info(err)
-		return false, err
-	}
-	if err != nil {
-		err := errors.New("error validating name")
-		glog.Error(err)
-		return false, err
+	allErrs := ruleErrors{}
+	if !nadNameRegexp.MatchString(netAttachDef.GetName()) {
+		allErrs = allErrs.add(RuleInvalidName, field.ErrorList{field.Invalid(field.NewPath("metadata", "name"), netAttachDef.GetName(),
+			"net-attach-def name is invalid, it must consist of lower case alphanumeric characters or '-', and must start and end with an alphanumeric character")})
 	}
 
 	glog.Infof("validating network config spec: %s", netAttachDef.Spec.Config)
 
 	var confBytes []byte
+	configPath := field.NewPath("spec", "config")
 	if netAttachDef.Spec.Config != "" {
 		// try to unmarshal config into NetworkConfig or NetworkConfigList
 		//  using actual code from libcni - if succesful, it means that the config
 		//  will be accepted by CNI itself as well
-		if !isJSON(netAttachDef.Spec.Config) {
-			err := errors.New("configuration string is not in JSON format")
-			glog.Info(err)
-			return false, err
+		var js map[string]interface{}
+		if err := json.Unmarshal([]byte(netAttachDef.Spec.Config), &js); err != nil {
+			allErrs = allErrs.add(RuleConfigNotJSON, field.ErrorList{field.Invalid(configPath, nil,
+				fmt.Sprintf("configuration string is not in JSON format: %v", err))})
+			glog.Info(allErrs)
+			return false, allErrs
 		}
 
+		var err error
 		confBytes, err = preprocessCNIConfig(netAttachDef.GetName(), []byte(netAttachDef.Spec.Config))
 		if err != nil {
-			err := errors.New("invalid json")
-			return false, err
-		}
-		if err := validateCNIConfig(confBytes); err != nil {
-			err := errors.New("invalid config")
-			return false, err
+			allErrs = allErrs.add(RuleConfigNotJSON, field.ErrorList{field.Invalid(configPath, nil, fmt.Sprintf("invalid json: %v", err))})
+			return false, allErrs
 		}
-		_, err = libcni.ConfListFromBytes(confBytes)
-		if err != nil {
-			glog.Infof("spec is not a valid network config list: %s - trying to parse into standalone config", err)
-			_, err = libcni.ConfFromBytes(confBytes)
+		configErrs := validateCNIConfig(confBytes, configPath)
+		allErrs = append(allErrs, configErrs...)
+		plugins, _ := pluginConfigs(js, configPath)
+		allErrs = allErrs.add(RuleDisallowedPluginType, validatePluginTypes(netAttachDef.GetNamespace(), plugins))
+		allErrs = allErrs.add(RuleForbiddenInterface, validateInterfaces(netAttachDef.GetNamespace(), plugins))
+		allErrs = append(allErrs, validateVLANs(netAttachDef, plugins)...)
+		allErrs = allErrs.add(RuleClusterNetworkOverlap, validateClusterNetworkOverlaps(plugins))
+		if len(configErrs) == 0 {
+			if _, isList := js["plugins"]; isList {
+				_, err = libcni.ConfListFromBytes(confBytes)
+			} else {
+				_, err = libcni.ConfFromBytes(confBytes)
+			}
 			if err != nil {
 				glog.Infof("spec is not a valid network config: %s", confBytes)
-				err := errors.New("invalid config")
-				return false, err
+				allErrs = allErrs.add(RuleInvalidConfig, field.ErrorList{field.Invalid(configPath, nil, fmt.Sprintf("invalid config: %v", err))})
 			}
 		}
 
@@ -152,10 +145,56 @@ func validateNetworkAttachmentDefinition(netAttachDef netv1.NetworkAttachmentDef
 		glog.Infof("Allowing empty spec.config")
 	}
 
+	if len(allErrs) > 0 {
+		glog.Info(allErrs)
+		return false, allErrs
+	}
 	glog.Infof("AdmissionReview request allowed: Network Attachment Definition '%s' is valid", confBytes)
 	return true, nil
 }
 
+// netAttachDefWarnings returns the violations of the rules which only warn about the
+// net-attach-def, it is allowed with them
+func netAttachDefWarnings(netAttachDef netv1.NetworkAttachmentDefinition) ruleErrors {
+	warnings := ruleErrors{}
+	var conf map[string]interface{}
+	if err := json.Unmarshal([]byte(netAttachDef.Spec.Config), &conf); err != nil {
+		return warnings
+	}
+	plugins, _ := pluginConfigs(conf, field.NewPath("spec", "config"))
+	warnings = warnings.add(RuleInvalidIPAM, ipamWarnings(plugins))
+	return warnings.add(RuleClusterNetworkOverlap, networkOverlapWarnings(plugins))
+}
+
+// addNetAttachDefWarnings adds the warnings about the net-attach-def to the response allowing
+// its creation, or an update of its config
+func addNetAttachDefWarnings(ar *v1beta1.AdmissionReview) {
+	if ar.Response == nil || !ar.Response.Allowed {
+		return
+	}
+	if ar.Request.Operation != v1beta1.Create && ar.Request.Operation != v1beta1.Update {
+		return
+	}
+	netAttachDef, err := deserializeNetworkAttachmentDefinition(ar)
+	if err != nil {
+		return
+	}
+	if ar.Request.Operation == v1beta1.Update && len(ar.Request.OldObject.Raw) > 0 {
+		oldNetAttachDef := netv1.NetworkAttachmentDefinition{}
+		if err := json.Unmarshal(ar.Request.OldObject.Raw, &oldNetAttachDef); err == nil &&
+			oldNetAttachDef.Spec.Config == netAttachDef.Spec.Config {
+			return
+		}
+	}
+	for _, warning := range netAttachDefWarnings(netAttachDef) {
+		message := warning.Error()
+		if fieldErr, ok := warning.err.(*field.Error); ok {
+			message = fmt.Sprintf("%s: %s", fieldErr.Field, fieldErr.Detail)
+		}
+		ar.Response.Warnings = append(ar.Response.Warnings, message)
+	}
+}
+
 func prepareAdmissionReviewResponse(allowed bool, message string, ar *v1beta1.AdmissionReview) error {
 	if ar.Request != nil {
 		ar.Response = &v1beta1.AdmissionResponse{
@@ -223,7 +262,6 @@ func deserializeAdmissionReview(body []byte) (*v1beta1.AdmissionReview, error) {
 
 func analyzeIsolationAnnotation(ar *v1beta1.AdmissionReview) (bool, error) {
 
-	var metadata *metav1.ObjectMeta
 	var pod v1.Pod
 
 	req := ar.Request
@@ -233,8 +271,37 @@ func analyzeIsolationAnnotation(ar *v1beta1.AdmissionReview) (bool, error) {
 		return false, err
 	}
 
-	metadata = &pod.ObjectMeta
-	annotations := metadata.GetAnnotations()
+	if req.Operation == v1beta1.Update && len(req.OldObject.Raw) > 0 {
+		var oldPod v1.Pod
+		if err := json.Unmarshal(req.OldObject.Raw, &oldPod); err == nil &&
+			oldPod.GetAnnotations()[networksAnnotationKey] == pod.GetAnnotations()[networksAnnotationKey] {
+			glog.Infof("Allowing update of pod %s/%s keeping its %s annotation", req.Namespace, pod.Name, networksAnnotationKey)
+			return true, nil
+		}
+	}
+
+	if pod.Namespace == "" {
+		pod.Namespace = req.Namespace
+	}
+	err := analyzePodIsolation(pod)
+	// the quotas only apply to new pods, existing pods already count
+	if req.Operation == v1beta1.Create {
+		if quotaErr := validatePodQuotas(pod); quotaErr != nil {
+			return false, append(ruleErrorsOf(err), ruleErrorsOf(quotaErr)...)
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+
+}
+
+// analyzePodIsolation checks the networks annotation of the pod only refers to
+// net-attach-defs of its own namespace, unless the namespace of the net-attach-def
+// shares it
+func analyzePodIsolation(pod v1.Pod) error {
+	annotations := pod.GetAnnotations()
 	if annotations == nil {
 		annotations = map[string]string{}
 	}
@@ -246,24 +313,35 @@ func analyzeIsolationAnnotation(ar *v1beta1.AdmissionReview) (bool, error) {
 		networks, err := parsePodNetworkAnnotation(annotations[networksAnnotationKey], namespaceConstraint)
 		if err != nil {
 			glog.Errorf("Error during parsePodNetworkAnnotation: %v", err)
-			return false, err
+			return ruleErrors{}.add(RuleInvalidNetworksAnnotation, field.ErrorList{
+				field.Invalid(networksAnnotationPath, annotations[networksAnnotationKey], err.Error())})
 		}
 
-		for _, item := range networks {
-			fmt.Printf("name: %v", item.Namespace)
-			if item.Namespace != namespaceConstraint {
-				annotationerrorstring := fmt.Sprintf("%s annotations must not refer to namespaced values (must use local namespace, i.e. must not contain a /), rejected: %s (namespace: %s)", networksAnnotationKey, annotations[networksAnnotationKey], item.Namespace)
-				annotationerror := errors.New(annotationerrorstring)
-				return false, annotationerror
+		allErrs := ruleErrors{}
+		for i, item := range networks {
+			glog.V(4).Infof("name: %v", item.Namespace)
+			if item.Namespace == namespaceConstraint {
+				continue
+			}
+			// the namespace owning the net-attach-def decides who attaches it, not the pod's
+			if namespacePolicyOf(item.Namespace).isolation == IsolationShared {
+				glog.Infof("Allowing %s, namespace %s is shared", networkReference(item), item.Namespace)
+				continue
 			}
+			annotationerrorstring := fmt.Sprintf("%s annotations must not refer to namespaced values (must use local namespace, i.e. must not contain a /), rejected: %s (namespace: %s)", networksAnnotationKey, networkReference(item), item.Namespace)
+			annotationerror := field.Forbidden(networksAnnotationPath.Index(i), annotationerrorstring)
+			allErrs = append(allErrs, newNetworkRuleError(RuleCrossNamespaceNetwork, annotationerror,
+				networkReference(item), item.Namespace+"/"+item.Name))
+		}
+		if len(allErrs) > 0 {
+			return allErrs
 		}
 
 		glog.Infof("Allowed value: %s", annotations[networksAnnotationKey])
 
 	}
 
-	return true, nil
-
+	return nil
 }
 
 func parsePodNetworkAnnotation(podNetworks, defaultNamespace string) ([]*types.NetworkSelectionElement, error) {
@@ -355,13 +433,52 @@ func deserializeNetworkAttachmentDefinition(ar *v1beta1.AdmissionReview) (netv1.
 	return netAttachDef, err
 }
 
+// reviewNetworkAttachmentDefinition validates the net-attach-def of the request according to
+// its operation: updates keeping the config are allowed, so net-attach-defs which predate a rule
+// can still be labeled or annotated. Only creations count against the quota
+func reviewNetworkAttachmentDefinition(ar *v1beta1.AdmissionReview) (bool, error) {
+	req := ar.Request
+	netAttachDef, err := deserializeNetworkAttachmentDefinition(ar)
+	if err != nil {
+		return false, err
+	}
+	if netAttachDef.Namespace == "" {
+		netAttachDef.Namespace = req.Namespace
+	}
+
+	if req.Operation == v1beta1.Update && len(req.OldObject.Raw) > 0 {
+		oldNetAttachDef := netv1.NetworkAttachmentDefinition{}
+		if err := json.Unmarshal(req.OldObject.Raw, &oldNetAttachDef); err == nil &&
+			oldNetAttachDef.Spec.Config == netAttachDef.Spec.Config {
+			glog.Infof("Allowing update of net-attach-def %s/%s keeping its config", req.Namespace, netAttachDef.Name)
+			return true, nil
+		}
+	}
+
+	allowed, err := validateNetworkAttachmentDefinition(netAttachDef)
+	if req.Operation == v1beta1.Create {
+		if quotaErrs := validateNetAttachDefQuota(netAttachDef); len(quotaErrs) > 0 {
+			return false, ruleErrorsOf(err).add(RuleNetAttachDefQuota, quotaErrs)
+		}
+	}
+	return allowed, err
+}
+
+// isDryRun tells whether the request must not have side effects
+func isDryRun(ar *v1beta1.AdmissionReview) bool {
+	return ar.Request != nil && ar.Request.DryRun != nil && *ar.Request.DryRun
+}
+
 func handleValidationError(w http.ResponseWriter, ar *v1beta1.AdmissionReview, orgErr error) {
-	err := prepareAdmissionReviewResponse(false, orgErr.Error(), ar)
+	err := prepareDenialResponse(ar, orgErr)
 	if err != nil {
 		err := errors.Wrap(err, "error preparing AdmissionResponse")
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if !isDryRun(ar) {
+		recordDenialEvent(ar, orgErr)
+	}
 	writeResponse(w, ar)
 }
 
@@ -376,11 +493,16 @@ func IsolateHandler(w http.ResponseWriter, req *http.Request) {
 
 	var allowed bool
 
+	start := time.Now()
 	ar, httpStatus, err := readAdmissionReview(req)
 	if err != nil {
 		http.Error(w, err.Error(), httpStatus)
 		return
 	}
+	defer logDecision(ar, start)
+	if allowExempt(w, ar, componentIsolate) {
+		return
+	}
 
 	allowed, err = analyzeIsolationAnnotation(ar)
 	if err != nil {
@@ -400,20 +522,19 @@ func IsolateHandler(w http.ResponseWriter, req *http.Request) {
 // ValidateHandler handles net-attach-def validation requests
 func ValidateHandler(w http.ResponseWriter, req *http.Request) {
 	/* read AdmissionReview from the HTTP request */
+	start := time.Now()
 	ar, httpStatus, err := readAdmissionReview(req)
 	if err != nil {
 		http.Error(w, err.Error(), httpStatus)
 		return
 	}
-
-	netAttachDef, err := deserializeNetworkAttachmentDefinition(ar)
-	if err != nil {
-		handleValidationError(w, ar, err)
+	defer logDecision(ar, start)
+	if allowExempt(w, ar, componentValidate) {
 		return
 	}
 
 	/* perform actual object validation */
-	allowed, err := validateNetworkAttachmentDefinition(netAttachDef)
+	allowed, err := reviewNetworkAttachmentDefinition(ar)
 	if err != nil {
 		handleValidationError(w, ar, err)
 		return
@@ -426,6 +547,7 @@ func ValidateHandler(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	addNetAttachDefWarnings(ar)
 	writeResponse(w, ar)
 }
 
@@ -441,4 +563,9 @@ func SetupInClusterClient() {
 	if err != nil {
 		glog.Fatal(err)
 	}
+
+	nadClientset, err = netattachdefClientset.NewForConfig(config)
+	if err != nil {
+		glog.Fatal(err)
+	}
 }
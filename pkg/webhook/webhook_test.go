@@ -20,16 +20,115 @@ import (
 	. "github.com/onsi/gomega"
 
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
 
 	"k8s.io/api/admission/v1beta1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 
+	"github.com/k8snetworkplumbingwg/net-attach-def-admission-controller/pkg/exemption"
 	netv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	nadfake "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/client/clientset/versioned/fake"
+	nadinformers "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/client/informers/externalversions"
 )
 
+// postReview sends an admission review of the request to the handler of the path and
+// returns the review it responds with
+func postReview(path string, request *v1beta1.AdmissionRequest) *v1beta1.AdmissionReview {
+	body, err := json.Marshal(v1beta1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1beta1", Kind: "AdmissionReview"},
+		Request:  request,
+	})
+	Expect(err).NotTo(HaveOccurred())
+	req := httptest.NewRequest("POST", "https://fakewebhook"+path, bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	if path == "/isolate" {
+		IsolateHandler(w, req)
+	} else {
+		ValidateHandler(w, req)
+	}
+	Expect(w.Result().StatusCode).To(Equal(http.StatusOK))
+	ar := &v1beta1.AdmissionReview{}
+	Expect(json.Unmarshal(w.Body.Bytes(), ar)).To(Succeed())
+	return ar
+}
+
+// newRequest returns the admission request of the operation on the objects
+func newRequest(kind string, operation v1beta1.Operation, object, oldObject interface{}) *v1beta1.AdmissionRequest {
+	request := &v1beta1.AdmissionRequest{
+		UID:       "fake-uid",
+		Kind:      metav1.GroupVersionKind{Kind: kind},
+		Namespace: "some-namespace",
+		Name:      "some-name",
+		Operation: operation,
+		UserInfo:  authenticationv1.UserInfo{Username: "some-user"},
+	}
+	for _, o := range []struct {
+		object interface{}
+		raw    *runtime.RawExtension
+	}{{object, &request.Object}, {oldObject, &request.OldObject}} {
+		if o.object != nil {
+			raw, err := json.Marshal(o.object)
+			Expect(err).NotTo(HaveOccurred())
+			o.raw.Raw = raw
+		}
+	}
+	return request
+}
+
+// watchNetworkAttachmentDefinitions caches the net-attach-defs of the fake clientset with a
+// shared informer, the way the webhook server does
+func watchNetworkAttachmentDefinitions(stopCh chan struct{}) error {
+	factory := nadinformers.NewSharedInformerFactory(nadClientset, 0)
+	informer := factory.K8sCniCncfIo().V1().NetworkAttachmentDefinitions().Informer()
+	factory.Start(stopCh)
+	return WatchNetworkAttachmentDefinitions(informer, stopCh)
+}
+
+// sendReview sends an admission review of the creation of the object to the handler of
+// the path and returns the denial it responds with
+func sendReview(path string, kind string, object interface{}) *v1beta1.AdmissionReview {
+	ar := postReview(path, newRequest(kind, v1beta1.Create, object, nil))
+	Expect(ar.Response.Allowed).To(BeFalse())
+	return ar
+}
+
+// syncBuffer is a bytes.Buffer safe to write from the decision logger goroutine
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
 var _ = Describe("Webhook", func() {
 
 	Describe("Preparing Admission Review Response", func() {
@@ -125,6 +224,46 @@ var _ = Describe("Webhook", func() {
 				Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
 			})
 		})
+
+		Context("Request is denied", func() {
+			var fakeRecorder *record.FakeRecorder
+
+			BeforeEach(func() {
+				fakeRecorder = record.NewFakeRecorder(10)
+				recorder = fakeRecorder
+			})
+
+			AfterEach(func() {
+				recorder = nil
+			})
+
+			It("validate - should set audit annotations and record an event on the namespace", func() {
+				ar := sendReview("/validate", "NetworkAttachmentDefinition", netv1.NetworkAttachmentDefinition{
+					ObjectMeta: metav1.ObjectMeta{Name: "some-name"},
+					Spec:       netv1.NetworkAttachmentDefinitionSpec{Config: `{"some-invalid": "config"}`},
+				})
+				Expect(ar.Response.AuditAnnotations).To(Equal(map[string]string{
+					"rule":           RuleInvalidConfig,
+					"net-attach-def": "some-namespace/some-name",
+				}))
+				Expect(fakeRecorder.Events).To(Receive(HavePrefix("Warning AdmissionDenied Denied CREATE of NetworkAttachmentDefinition some-name")))
+			})
+
+			It("isolate - should set the offending network in audit annotations", func() {
+				ar := sendReview("/isolate", "Pod", v1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:        "some-name",
+						Annotations: map[string]string{networksAnnotationKey: "some-net,other-namespace/other-net@net1"},
+					},
+				})
+				Expect(ar.Response.AuditAnnotations).To(Equal(map[string]string{
+					"rule":           RuleCrossNamespaceNetwork,
+					"network":        "other-namespace/other-net@net1",
+					"net-attach-def": "other-namespace/other-net",
+				}))
+				Expect(fakeRecorder.Events).To(Receive(ContainSubstring("Pod some-name")))
+			})
+		})
 	})
 
 	DescribeTable("Network Attachment Definition validation",
@@ -206,4 +345,1149 @@ var _ = Describe("Webhook", func() {
 			true, false,
 		),
 	)
+
+	DescribeTable("Network Attachment Definition audit",
+		func(in netv1.NetworkAttachmentDefinition, rules []string) {
+			var actual []string
+			for _, violation := range AuditNetworkAttachmentDefinition(in) {
+				Expect(violation.Message).NotTo(BeEmpty())
+				actual = append(actual, violation.Rule)
+			}
+			Expect(actual).To(Equal(rules))
+		},
+		Entry(
+			"invalid name",
+			netv1.NetworkAttachmentDefinition{
+				ObjectMeta: metav1.ObjectMeta{Name: "some?invalid?name"},
+			},
+			[]string{RuleInvalidName},
+		),
+		Entry(
+			"config not in JSON format",
+			netv1.NetworkAttachmentDefinition{
+				ObjectMeta: metav1.ObjectMeta{Name: "some-valid-name"},
+				Spec:       netv1.NetworkAttachmentDefinitionSpec{Config: "not json"},
+			},
+			[]string{RuleConfigNotJSON},
+		),
+		Entry(
+			"invalid network config",
+			netv1.NetworkAttachmentDefinition{
+				ObjectMeta: metav1.ObjectMeta{Name: "some-valid-name"},
+				Spec:       netv1.NetworkAttachmentDefinitionSpec{Config: `{"some-invalid": "config"}`},
+			},
+			[]string{RuleInvalidConfig},
+		),
+		Entry(
+			"valid network config",
+			netv1.NetworkAttachmentDefinition{
+				ObjectMeta: metav1.ObjectMeta{Name: "some-valid-name"},
+				Spec:       netv1.NetworkAttachmentDefinitionSpec{Config: `{"cniVersion": "0.3.0", "type": "some-plugin"}`},
+			},
+			nil,
+		),
+	)
+
+	DescribeTable("Pod isolation audit",
+		func(networks string, rules []string) {
+			pod := v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "some-pod",
+					Namespace:   "some-namespace",
+					Annotations: map[string]string{networksAnnotationKey: networks},
+				},
+			}
+			var actual []string
+			for _, violation := range AuditPod(pod) {
+				actual = append(actual, violation.Rule)
+			}
+			Expect(actual).To(Equal(rules))
+		},
+		Entry("local network", "some-net", nil),
+		Entry("no networks", "", nil),
+		Entry("network of another namespace", "other-namespace/some-net", []string{RuleCrossNamespaceNetwork}),
+		Entry("invalid annotation", "some?net", []string{RuleInvalidNetworksAnnotation}),
+	)
+
+	Describe("Decision log", func() {
+		AfterEach(func() {
+			decisions = nil
+		})
+
+		It("should log a JSON line per decision", func() {
+			out := &syncBuffer{}
+			decisions = newDecisionLogger(out, 10)
+			postReview("/isolate", newRequest("Pod", v1beta1.Create, v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "some-name",
+					Annotations: map[string]string{networksAnnotationKey: "other-namespace/other-net"},
+				},
+			}, nil))
+			Eventually(out.String).Should(HaveSuffix("\n"))
+
+			entry := decision{}
+			Expect(json.Unmarshal([]byte(out.String()), &entry)).To(Succeed())
+			Expect(entry.UID).To(BeEquivalentTo("fake-uid"))
+			Expect(entry.Kind).To(Equal("Pod"))
+			Expect(entry.Namespace).To(Equal("some-namespace"))
+			Expect(entry.Name).To(Equal("some-name"))
+			Expect(entry.Operation).To(Equal("CREATE"))
+			Expect(entry.User).To(Equal("some-user"))
+			Expect(entry.Verdict).To(Equal(verdictDenied))
+			Expect(entry.Rules).To(Equal([]string{RuleCrossNamespaceNetwork}))
+			Expect(entry.Latency).To(BeNumerically(">=", 0))
+		})
+
+		It("should drop decisions instead of blocking", func() {
+			logger := &decisionLogger{entries: make(chan decision, 1)}
+			logger.log(decision{UID: "first"})
+			logger.log(decision{UID: "second"})
+			Expect(logger.entries).To(HaveLen(1))
+			Expect(logger.dropped).To(BeEquivalentTo(1))
+		})
+
+		It("should rotate the file by size", func() {
+			dir, err := ioutil.TempDir("", "decisions")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "decisions.log")
+
+			file, err := newRotatingFile(path, 10, 2)
+			Expect(err).NotTo(HaveOccurred())
+			for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+				_, err := file.Write([]byte(line))
+				Expect(err).NotTo(HaveOccurred())
+			}
+			for suffix, content := range map[string]string{"": "fourth\n", ".1": "third\n", ".2": "second\n"} {
+				data, err := ioutil.ReadFile(path + suffix)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(data)).To(Equal(content))
+			}
+			_, err = os.Stat(path + ".3")
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("should keep logging when the file cannot be rotated", func() {
+			dir, err := ioutil.TempDir("", "decisions")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "decisions.log")
+			// a directory in the way of the backup makes the rename fail
+			Expect(os.MkdirAll(filepath.Join(path+".1", "busy"), 0755)).To(Succeed())
+
+			file, err := newRotatingFile(path, 10, 1)
+			Expect(err).NotTo(HaveOccurred())
+			for _, line := range []string{"first\n", "second\n", "third\n"} {
+				_, err := file.Write([]byte(line))
+				Expect(err).NotTo(HaveOccurred())
+			}
+			data, err := ioutil.ReadFile(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).To(Equal("first\nsecond\nthird\n"))
+
+			By("rotating once the backup can be written")
+			Expect(os.RemoveAll(path + ".1")).To(Succeed())
+			_, err = file.Write([]byte("fourth\n"))
+			Expect(err).NotTo(HaveOccurred())
+			for suffix, content := range map[string]string{"": "fourth\n", ".1": "first\nsecond\nthird\n"} {
+				data, err := ioutil.ReadFile(path + suffix)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(data)).To(Equal(content))
+			}
+		})
+	})
+
+	DescribeTable("Reviewing without a webhook",
+		func(kind string, object interface{}, allowed bool, rule string) {
+			raw, err := json.Marshal(object)
+			Expect(err).NotTo(HaveOccurred())
+			ar := &v1beta1.AdmissionReview{
+				Request: &v1beta1.AdmissionRequest{
+					Kind:      metav1.GroupVersionKind{Kind: kind},
+					Namespace: "some-namespace",
+					Object:    runtime.RawExtension{Raw: raw},
+				},
+			}
+			Expect(Review(ar)).To(Succeed())
+			Expect(ar.Response.Allowed).To(Equal(allowed))
+			Expect(ar.Response.AuditAnnotations[auditAnnotationRule]).To(Equal(rule))
+		},
+		Entry("valid net-attach-def", "NetworkAttachmentDefinition", netv1.NetworkAttachmentDefinition{
+			ObjectMeta: metav1.ObjectMeta{Name: "some-valid-name"},
+			Spec:       netv1.NetworkAttachmentDefinitionSpec{Config: `{"cniVersion": "0.3.0", "type": "some-plugin"}`},
+		}, true, ""),
+		Entry("invalid net-attach-def", "NetworkAttachmentDefinition", netv1.NetworkAttachmentDefinition{
+			ObjectMeta: metav1.ObjectMeta{Name: "some-valid-name"},
+			Spec:       netv1.NetworkAttachmentDefinitionSpec{Config: `{"some-invalid": "config"}`},
+		}, false, RuleInvalidConfig),
+		Entry("pod attaching a local network", "Pod", v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{networksAnnotationKey: "some-net"}},
+		}, true, ""),
+		Entry("pod attaching a network of another namespace", "Pod", v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{networksAnnotationKey: "other-namespace/some-net"}},
+		}, false, RuleCrossNamespaceNetwork),
+	)
+
+	It("should not review unsupported kinds", func() {
+		ar := &v1beta1.AdmissionReview{
+			Request: &v1beta1.AdmissionRequest{
+				Kind:   metav1.GroupVersionKind{Kind: "Deployment"},
+				Object: runtime.RawExtension{Raw: []byte("{}")},
+			},
+		}
+		Expect(Review(ar)).NotTo(Succeed())
+		Expect(ar.Response).To(BeNil())
+	})
+
+	Describe("Evaluating objects", func() {
+		var token string
+
+		evaluateBody := func(method, body string) (*httptest.ResponseRecorder, *EvaluationReport) {
+			req := httptest.NewRequest(method, "https://fakewebhook/evaluate?namespace=some-namespace", bytes.NewBufferString(body))
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			w := httptest.NewRecorder()
+			EvaluateHandler(w, req)
+			if w.Code != http.StatusOK {
+				return w, nil
+			}
+			report := &EvaluationReport{}
+			Expect(json.Unmarshal(w.Body.Bytes(), report)).To(Succeed())
+			return w, report
+		}
+
+		BeforeEach(func() {
+			token = "some-token"
+			client := fake.NewSimpleClientset()
+			// some-token authenticates some-user, other-token other-user, who may only create pods
+			client.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+				switch review.Spec.Token {
+				case "some-token":
+					review.Status = authenticationv1.TokenReviewStatus{Authenticated: true,
+						User: authenticationv1.UserInfo{Username: "some-user", Groups: []string{"some-group"}}}
+				case "other-token":
+					review.Status = authenticationv1.TokenReviewStatus{Authenticated: true,
+						User: authenticationv1.UserInfo{Username: "other-user"}}
+				}
+				return true, review, nil
+			})
+			client.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+				attributes := review.Spec.ResourceAttributes
+				review.Status.Allowed = attributes.Verb == "create" && attributes.Namespace == "some-namespace" &&
+					(review.Spec.User == "some-user" || attributes.Resource == "pods")
+				return true, review, nil
+			})
+			clientset = client
+		})
+
+		AfterEach(func() {
+			clientset = nil
+			nadClientset = nil
+			exemptions = nil
+		})
+
+		It("should report the rules of a net-attach-def in YAML", func() {
+			_, report := evaluateBody("POST", `
+apiVersion: k8s.cni.cncf.io/v1
+kind: NetworkAttachmentDefinition
+metadata:
+  name: some-name
+spec:
+  config: '{"some-invalid": "config"}'
+`)
+			Expect(report).NotTo(BeNil())
+			Expect(report.Namespace).To(Equal("some-namespace"))
+			Expect(report.Allowed).To(BeFalse())
+			Expect(report.Results).To(Equal([]RuleResult{
+				{Rule: RuleInvalidName, Result: resultPass, Field: "metadata.name"},
+				{Rule: RuleConfigNotJSON, Result: resultPass, Field: "spec.config"},
+				{Rule: RuleInvalidConfig, Result: resultFail, Field: "spec.config.type", Message: "spec.config.type: Required value: missing 'type' in cni config"},
+				{Rule: RuleInvalidIPAM, Result: resultPass, Field: "spec.config"},
+				{Rule: RuleDisallowedPluginType, Result: resultPass, Field: "spec.config"},
+				{Rule: RuleForbiddenInterface, Result: resultPass, Field: "spec.config"},
+				{Rule: RuleInvalidVLAN, Result: resultPass, Field: "spec.config"},
+				{Rule: RuleForbiddenVLAN, Result: resultPass, Field: "spec.config"},
+				{Rule: RuleVLANConflict, Result: resultPass, Field: "spec.config"},
+				{Rule: RuleClusterNetworkOverlap, Result: resultPass, Field: "spec.config"},
+				{Rule: RuleNetAttachDefQuota, Result: resultPass, Field: "metadata.namespace"},
+			}))
+		})
+
+		It("should warn about networks of a pod missing in the cluster", func() {
+			nadClient := nadfake.NewSimpleClientset()
+			_, err := nadClient.K8sCniCncfIoV1().NetworkAttachmentDefinitions("some-namespace").Create(context.TODO(),
+				&netv1.NetworkAttachmentDefinition{ObjectMeta: metav1.ObjectMeta{Namespace: "some-namespace", Name: "some-net"}}, metav1.CreateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			nadClientset = nadClient
+
+			_, report := evaluateBody("POST", `{"apiVersion": "v1", "kind": "Pod", "metadata": {"name": "some-pod",
+				"annotations": {"k8s.v1.cni.cncf.io/networks": "some-net,missing-net"}}}`)
+			Expect(report).NotTo(BeNil())
+			Expect(report.Allowed).To(BeTrue())
+			Expect(report.Results).To(HaveLen(5))
+			Expect(report.Results[4].Rule).To(Equal(RuleMissingNetwork))
+			Expect(report.Results[4].Result).To(Equal(resultWarn))
+			Expect(report.Results[4].Field).To(Equal("metadata.annotations[k8s.v1.cni.cncf.io/networks]"))
+			Expect(report.Results[4].Message).To(ContainSubstring("some-namespace/missing-net"))
+			Expect(report.Results[4].Message).NotTo(ContainSubstring("some-namespace/some-net"))
+		})
+
+		It("should skip the rules after a failed one", func() {
+			_, report := evaluateBody("POST", `{"apiVersion": "v1", "kind": "Pod", "metadata": {"name": "some-pod",
+				"annotations": {"k8s.v1.cni.cncf.io/networks": "some?net"}}}`)
+			Expect(report).NotTo(BeNil())
+			Expect(report.Allowed).To(BeFalse())
+			Expect(report.Results[0].Result).To(Equal(resultFail))
+			Expect(report.Results[1].Result).To(Equal(resultSkip))
+		})
+
+		It("should reject unsupported kinds and methods", func() {
+			w, _ := evaluateBody("POST", `{"apiVersion": "apps/v1", "kind": "Deployment"}`)
+			Expect(w.Code).To(Equal(http.StatusBadRequest))
+			w, _ = evaluateBody("GET", "")
+			Expect(w.Code).To(Equal(http.StatusMethodNotAllowed))
+		})
+
+		DescribeTable("should only evaluate for users who may create the object",
+			func(requestToken, body string, status int) {
+				token = requestToken
+				w, _ := evaluateBody("POST", body)
+				Expect(w.Code).To(Equal(status))
+			},
+			Entry("without token", "", `{"apiVersion": "v1", "kind": "Pod", "metadata": {"name": "some-pod"}}`, http.StatusUnauthorized),
+			Entry("with an invalid token", "invalid-token", `{"apiVersion": "v1", "kind": "Pod", "metadata": {"name": "some-pod"}}`, http.StatusUnauthorized),
+			Entry("for a pod the user may create", "other-token", `{"apiVersion": "v1", "kind": "Pod", "metadata": {"name": "some-pod"}}`, http.StatusOK),
+			Entry("for a net-attach-def the user may not create", "other-token",
+				`{"apiVersion": "k8s.cni.cncf.io/v1", "kind": "NetworkAttachmentDefinition", "metadata": {"name": "some-name"}}`, http.StatusForbidden),
+			Entry("in a namespace the user may not create pods in", "some-token",
+				`{"apiVersion": "v1", "kind": "Pod", "metadata": {"name": "some-pod", "namespace": "other-namespace"}}`, http.StatusForbidden),
+		)
+
+		It("should refuse evaluations without a cluster client", func() {
+			clientset = nil
+			w, _ := evaluateBody("POST", `{"apiVersion": "v1", "kind": "Pod", "metadata": {"name": "some-pod"}}`)
+			Expect(w.Code).To(Equal(http.StatusServiceUnavailable))
+		})
+
+		It("should allow objects exempt for the user", func() {
+			exemptions = exemption.New(exemption.Config{Groups: []string{"some-group"}}, nil)
+			body := `{"apiVersion": "v1", "kind": "Pod", "metadata": {"name": "some-pod",
+				"annotations": {"k8s.v1.cni.cncf.io/networks": "other-namespace/some-net"}}}`
+			_, report := evaluateBody("POST", body)
+			Expect(report).NotTo(BeNil())
+			Expect(report.Allowed).To(BeTrue())
+			Expect(report.Exemption).To(Equal(exemption.ReasonGroup))
+			Expect(report.Results[1].Result).To(Equal(resultFail))
+
+			token = "other-token"
+			_, report = evaluateBody("POST", body)
+			Expect(report.Allowed).To(BeFalse())
+			Expect(report.Exemption).To(BeEmpty())
+		})
+	})
+
+	Describe("Validating a net-attach-def with several errors", func() {
+		AfterEach(func() {
+			ipamAction = IPAMWarn
+		})
+
+		It("should report all of them with their field paths", func() {
+			Expect(SetIPAMValidation(IPAMDeny)).To(Succeed())
+			_, err := validateNetworkAttachmentDefinition(netv1.NetworkAttachmentDefinition{
+				ObjectMeta: metav1.ObjectMeta{Name: "some?invalid?name"},
+				Spec: netv1.NetworkAttachmentDefinitionSpec{
+					Config: `{
+						"cniVersion": "0.3.1",
+						"name": "some-network",
+						"plugins": [{
+							"bridge": "br0"
+						},
+						{
+							"type": "macvlan",
+							"ipam": {
+								"type": "host-local",
+								"subnet": "192.168.1.0/33",
+								"routes": [{"dst": "0.0.0.0/0", "gw": "not-an-ip"}]
+							}
+						},
+						{
+							"type": "tuning",
+							"ipam": {
+								"type": "whereabouts",
+								"range": "192.168.2.225-192.168.2.0/28",
+								"exclude": ["192.168.2.229/30", "192.168.2.300/32"]
+							}
+						}]
+					}`,
+				},
+			})
+			Expect(err).To(HaveOccurred())
+			var fields, rules []string
+			for _, violation := range violationsOf(err) {
+				fields = append(fields, violation.Field)
+				rules = append(rules, violation.Rule)
+			}
+			Expect(fields).To(Equal([]string{
+				"metadata.name",
+				"spec.config.plugins[0].type",
+				"spec.config.plugins[1].ipam.subnet",
+				"spec.config.plugins[1].ipam.routes[0].gw",
+				"spec.config.plugins[2].ipam.exclude[1]",
+			}))
+			Expect(rules).To(Equal([]string{
+				RuleInvalidName, RuleInvalidConfig, RuleInvalidIPAM, RuleInvalidIPAM, RuleInvalidIPAM,
+			}))
+			Expect(err.Error()).To(HavePrefix("[metadata.name: Invalid value: \"some?invalid?name\""))
+			Expect(err.Error()).To(ContainSubstring("spec.config.plugins[1].ipam.subnet: Invalid value: \"192.168.1.0/33\""))
+		})
+
+		It("should only warn about invalid IPAM sections by default", func() {
+			config := `{"cniVersion": "0.3.1", "name": "some-net", "type": "macvlan", "ipam": {"type": "host-local", "subnet": "192.168.1.0/33"}}`
+			nad := netv1.NetworkAttachmentDefinition{
+				TypeMeta:   metav1.TypeMeta{APIVersion: "k8s.cni.cncf.io/v1", Kind: "NetworkAttachmentDefinition"},
+				ObjectMeta: metav1.ObjectMeta{Name: "some-net"},
+				Spec:       netv1.NetworkAttachmentDefinitionSpec{Config: config},
+			}
+			response := postReview("/validate", newRequest("NetworkAttachmentDefinition", v1beta1.Create, nad, nil)).Response
+			Expect(response.Allowed).To(BeTrue())
+			Expect(response.Warnings).To(ConsistOf("spec.config.ipam.subnet: must be a CIDR, e.g. 192.168.1.0/24"))
+
+			raw, err := json.Marshal(nad)
+			Expect(err).NotTo(HaveOccurred())
+			report, err := evaluate(raw, "some-namespace")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report.Allowed).To(BeTrue())
+			Expect(report.Results).To(ContainElement(RuleResult{Rule: RuleInvalidIPAM, Result: resultWarn, Field: "spec.config.ipam.subnet",
+				Message: `spec.config.ipam.subnet: Invalid value: "192.168.1.0/33": must be a CIDR, e.g. 192.168.1.0/24`}))
+
+			By("denying them when asked to")
+			Expect(SetIPAMValidation("ignore")).To(MatchError(ContainSubstring("invalid action")))
+			Expect(SetIPAMValidation(IPAMDeny)).To(Succeed())
+			response = postReview("/validate", newRequest("NetworkAttachmentDefinition", v1beta1.Create, nad, nil)).Response
+			Expect(response.Allowed).To(BeFalse())
+			Expect(response.AuditAnnotations).To(HaveKeyWithValue(auditAnnotationRule, RuleInvalidIPAM))
+		})
+
+		It("should keep the libcni error", func() {
+			_, err := validateNetworkAttachmentDefinition(netv1.NetworkAttachmentDefinition{
+				ObjectMeta: metav1.ObjectMeta{Name: "some-valid-name"},
+				Spec: netv1.NetworkAttachmentDefinitionSpec{
+					Config: `{"cniVersion": "0.3.1", "plugins": [{"type": "bridge"}]}`,
+				},
+			})
+			Expect(err).To(MatchError(ContainSubstring("spec.config: invalid config: error parsing configuration list: no name")))
+		})
+
+		It("should set every offending rule and network in the audit annotations", func() {
+			ar := sendReview("/isolate", "Pod", v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "some-name",
+					Annotations: map[string]string{networksAnnotationKey: "first/net,some-net,second/net"},
+				},
+			})
+			Expect(ar.Response.AuditAnnotations).To(Equal(map[string]string{
+				"rule":           RuleCrossNamespaceNetwork,
+				"network":        "first/net,second/net",
+				"net-attach-def": "first/net,second/net",
+			}))
+			Expect(ar.Response.Result.Message).To(HavePrefix("[metadata.annotations[k8s.v1.cni.cncf.io/networks][0]: Forbidden"))
+		})
+	})
+
+	Describe("Handling operations", func() {
+		invalidNad := netv1.NetworkAttachmentDefinition{
+			ObjectMeta: metav1.ObjectMeta{Name: "some-name"},
+			Spec:       netv1.NetworkAttachmentDefinitionSpec{Config: `{"some-invalid": "config"}`},
+		}
+		validNad := netv1.NetworkAttachmentDefinition{
+			ObjectMeta: metav1.ObjectMeta{Name: "some-name"},
+			Spec:       netv1.NetworkAttachmentDefinitionSpec{Config: `{"cniVersion": "0.3.0", "type": "some-plugin"}`},
+		}
+		foreignPod := v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "some-name",
+				Annotations: map[string]string{networksAnnotationKey: "other-namespace/some-net"},
+			},
+		}
+		labeled := func(pod v1.Pod) v1.Pod {
+			pod.Labels = map[string]string{"some": "label"}
+			return pod
+		}
+
+		DescribeTable("should only check what the operation changes",
+			func(path string, request *v1beta1.AdmissionRequest, allowed bool) {
+				Expect(postReview(path, request).Response.Allowed).To(Equal(allowed))
+			},
+			Entry("net-attach-def update keeping an invalid config", "/validate",
+				newRequest("NetworkAttachmentDefinition", v1beta1.Update, invalidNad, invalidNad), true),
+			Entry("net-attach-def update to an invalid config", "/validate",
+				newRequest("NetworkAttachmentDefinition", v1beta1.Update, invalidNad, validNad), false),
+			Entry("net-attach-def update without the old object", "/validate",
+				newRequest("NetworkAttachmentDefinition", v1beta1.Update, invalidNad, nil), false),
+			Entry("pod update keeping its networks", "/isolate",
+				newRequest("Pod", v1beta1.Update, labeled(foreignPod), foreignPod), true),
+			Entry("pod update of its networks", "/isolate",
+				newRequest("Pod", v1beta1.Update, foreignPod, v1.Pod{}), false),
+		)
+
+		It("should not record events nor decisions of dry runs", func() {
+			fakeRecorder := record.NewFakeRecorder(10)
+			recorder = fakeRecorder
+			out := &syncBuffer{}
+			decisions = newDecisionLogger(out, 10)
+			defer func() {
+				recorder = nil
+				decisions = nil
+			}()
+
+			dryRun := true
+			request := newRequest("NetworkAttachmentDefinition", v1beta1.Create, invalidNad, nil)
+			request.DryRun = &dryRun
+			Expect(postReview("/validate", request).Response.Allowed).To(BeFalse())
+			Consistently(out.String, "100ms").Should(BeEmpty())
+			Expect(fakeRecorder.Events).NotTo(Receive())
+		})
+	})
+
+	Describe("Exempting requests", func() {
+		invalidNad := netv1.NetworkAttachmentDefinition{
+			ObjectMeta: metav1.ObjectMeta{Name: "some-name", Labels: map[string]string{"some": "label"}},
+			Spec:       netv1.NetworkAttachmentDefinitionSpec{Config: `{"some-invalid": "config"}`},
+		}
+		foreignPod := v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "some-name",
+				Annotations: map[string]string{networksAnnotationKey: "other-namespace/some-net"},
+			},
+		}
+		byUser := func(user string, request *v1beta1.AdmissionRequest) *v1beta1.AdmissionRequest {
+			request.UserInfo.Username = user
+			return request
+		}
+		inNamespace := func(namespace string, request *v1beta1.AdmissionRequest) *v1beta1.AdmissionRequest {
+			request.Namespace = namespace
+			return request
+		}
+
+		BeforeEach(func() {
+			config, err := exemption.ParseConfig("exempt-namespace", "", "", "", "kube-system/*", "some=label")
+			Expect(err).NotTo(HaveOccurred())
+			exemptions = exemption.New(config, nil)
+		})
+
+		AfterEach(func() {
+			exemptions = nil
+		})
+
+		DescribeTable("should allow exempt requests without checks",
+			func(path string, request *v1beta1.AdmissionRequest, reason string) {
+				response := postReview(path, request).Response
+				if reason == "" {
+					Expect(response.Allowed).To(BeFalse())
+					Expect(response.AuditAnnotations).NotTo(HaveKey(auditAnnotationExemption))
+					return
+				}
+				Expect(response.Allowed).To(BeTrue())
+				Expect(response.AuditAnnotations).To(HaveKeyWithValue(auditAnnotationExemption, reason))
+			},
+			Entry("net-attach-def matching the object selector", "/validate",
+				newRequest("NetworkAttachmentDefinition", v1beta1.Create, invalidNad, nil), exemption.ReasonObjectSelector),
+			Entry("pod in an exempt namespace", "/isolate",
+				inNamespace("exempt-namespace", newRequest("Pod", v1beta1.Create, foreignPod, nil)), exemption.ReasonNamespace),
+			Entry("pod created by an exempt service account", "/isolate",
+				byUser("system:serviceaccount:kube-system:some-operator", newRequest("Pod", v1beta1.Create, foreignPod, nil)),
+				exemption.ReasonServiceAccount),
+			Entry("pod created by another service account", "/isolate",
+				byUser("system:serviceaccount:some-namespace:some-operator", newRequest("Pod", v1beta1.Create, foreignPod, nil)), ""),
+		)
+	})
+
+	Describe("Namespace policies", func() {
+		newNamespace := func(name string, labels, annotations map[string]string) *v1.Namespace {
+			return &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels, Annotations: annotations}}
+		}
+		nadOfType := func(pluginType string) netv1.NetworkAttachmentDefinition {
+			return netv1.NetworkAttachmentDefinition{
+				ObjectMeta: metav1.ObjectMeta{Name: "some-name"},
+				Spec: netv1.NetworkAttachmentDefinitionSpec{Config: fmt.Sprintf(
+					`{"cniVersion": "0.3.1", "name": "some-net", "plugins": [{"type": "macvlan"}, {"type": "%s"}]}`, pluginType)},
+			}
+		}
+		podAttaching := func(networks string) v1.Pod {
+			return v1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Name:        "some-name",
+				Annotations: map[string]string{networksAnnotationKey: networks},
+			}}
+		}
+		inNamespace := func(namespace string, request *v1beta1.AdmissionRequest) *v1beta1.AdmissionRequest {
+			request.Namespace = namespace
+			return request
+		}
+
+		BeforeEach(func() {
+			clientset = fake.NewSimpleClientset(
+				newNamespace("strict-namespace", map[string]string{isolationKey: IsolationStrict}, nil),
+				newNamespace("shared-namespace", map[string]string{isolationKey: IsolationShared}, nil),
+				newNamespace("open-namespace", nil, map[string]string{isolationKey: "off"}),
+				newNamespace("tenant-namespace", nil, map[string]string{allowedPluginTypesKey: "macvlan, sriov"}),
+				newNamespace("invalid-namespace", map[string]string{isolationKey: "none"}, nil),
+			)
+		})
+
+		AfterEach(func() {
+			clientset = nil
+		})
+
+		DescribeTable("should isolate pods according to the namespaces",
+			func(namespace, networks string, allowed bool) {
+				request := inNamespace(namespace, newRequest("Pod", v1beta1.Create, podAttaching(networks), nil))
+				Expect(postReview("/isolate", request).Response.Allowed).To(Equal(allowed))
+			},
+			Entry("strict namespace attaching its own network", "strict-namespace", "some-net", true),
+			Entry("strict namespace attaching another namespace", "strict-namespace", "other-namespace/some-net", false),
+			Entry("strict namespace attaching a shared namespace", "strict-namespace", "shared-namespace/some-net", true),
+			Entry("namespace without policy attaching a shared namespace", "some-namespace", "shared-namespace/some-net", true),
+			Entry("shared namespace attaching another namespace", "shared-namespace", "strict-namespace/some-net", false),
+			Entry("namespace with isolation off attaching a strict namespace", "open-namespace", "strict-namespace/some-net", false),
+			Entry("namespace with isolation off attaching a shared namespace", "open-namespace", "shared-namespace/some-net", true),
+			Entry("strict namespace attaching a namespace with isolation off, which is invalid", "strict-namespace", "open-namespace/some-net", false),
+			Entry("namespace with an invalid isolation", "invalid-namespace", "other-namespace/some-net", false),
+		)
+
+		DescribeTable("should only allow the plugin types of the namespace",
+			func(namespace, pluginType string, allowed bool) {
+				request := inNamespace(namespace, newRequest("NetworkAttachmentDefinition", v1beta1.Create, nadOfType(pluginType), nil))
+				Expect(postReview("/validate", request).Response.Allowed).To(Equal(allowed))
+			},
+			Entry("allowed type", "tenant-namespace", "sriov", true),
+			Entry("type not allowed", "tenant-namespace", "host-device", false),
+			Entry("namespace without allowed types", "strict-namespace", "host-device", true),
+		)
+
+		It("should name the plugin not allowed", func() {
+			request := inNamespace("tenant-namespace", newRequest("NetworkAttachmentDefinition", v1beta1.Create, nadOfType("host-device"), nil))
+			response := postReview("/validate", request).Response
+			Expect(response.Result.Message).To(ContainSubstring(`spec.config.plugins[1].type: Unsupported value: "host-device"`))
+			Expect(response.AuditAnnotations).To(HaveKeyWithValue(auditAnnotationRule, RuleDisallowedPluginType))
+		})
+	})
+
+	Describe("Cluster policy", func() {
+		var dir string
+
+		writePolicy := func(policy string) string {
+			path := filepath.Join(dir, "policy.yaml")
+			Expect(ioutil.WriteFile(path, []byte(policy), 0600)).To(Succeed())
+			return path
+		}
+		validate := func(namespace, config string) *v1beta1.AdmissionResponse {
+			nad := netv1.NetworkAttachmentDefinition{
+				ObjectMeta: metav1.ObjectMeta{Name: "some-name"},
+				Spec:       netv1.NetworkAttachmentDefinitionSpec{Config: config},
+			}
+			request := newRequest("NetworkAttachmentDefinition", v1beta1.Create, nad, nil)
+			request.Namespace = namespace
+			return postReview("/validate", request).Response
+		}
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "policy")
+			Expect(err).NotTo(HaveOccurred())
+			clientset = fake.NewSimpleClientset(
+				&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "tenant-namespace", Labels: map[string]string{"tier": "tenant"}}},
+				&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "platform-namespace"}},
+			)
+			Expect(LoadPolicy(writePolicy(`
+pluginTypes:
+- namespaceSelector:
+    matchLabels:
+      tier: tenant
+  denied: [host-device, sriov]
+- namespaces: [restricted-namespace]
+  allowed: [macvlan, ipvlan]
+interfaces:
+- forbidden: [eth0, br-ex]
+- namespaceSelector:
+    matchLabels:
+      tier: tenant
+  allowed: ["ens*f1", "0000:3b:*"]
+`))).To(Succeed())
+		})
+
+		AfterEach(func() {
+			clientset = nil
+			clusterPolicy = nil
+			os.RemoveAll(dir)
+		})
+
+		DescribeTable("should enforce the plugin types of the namespace",
+			func(namespace, config, message string) {
+				response := validate(namespace, config)
+				if message == "" {
+					Expect(response.Allowed).To(BeTrue())
+					return
+				}
+				Expect(response.Allowed).To(BeFalse())
+				Expect(response.Result.Message).To(ContainSubstring(message))
+				Expect(response.AuditAnnotations).To(HaveKeyWithValue(auditAnnotationRule, RuleDisallowedPluginType))
+			},
+			Entry("denied type in a conflist", "tenant-namespace",
+				`{"cniVersion": "0.3.1", "name": "some-net", "plugins": [{"type": "macvlan"}, {"type": "host-device"}]}`,
+				`spec.config.plugins[1].type: Forbidden: plugin type "host-device" is denied in namespace tenant-namespace`),
+			Entry("denied type in a namespace out of the scope", "platform-namespace",
+				`{"cniVersion": "0.3.1", "name": "some-net", "type": "host-device"}`, ""),
+			Entry("denied type in a nested delegate", "tenant-namespace",
+				`{"cniVersion": "0.3.1", "name": "some-net", "type": "multus", "delegates": [{"type": "macvlan"}, {"type": "sriov"}]}`,
+				`spec.config.delegates[1].type: Forbidden: plugin type "sriov" is denied`),
+			Entry("type not allowed", "restricted-namespace",
+				`{"cniVersion": "0.3.1", "name": "some-net", "type": "bridge"}`,
+				`spec.config.type: Unsupported value: "bridge"`),
+			Entry("flannel delegating to a bridge", "restricted-namespace",
+				`{"cniVersion": "0.3.1", "name": "some-net", "type": "macvlan", "delegate": {"type": "flannel", "delegate": {"isDefaultGateway": true}}}`,
+				`spec.config.delegate.delegate.type: Unsupported value: "bridge"`),
+			Entry("allowed type", "restricted-namespace",
+				`{"cniVersion": "0.3.1", "name": "some-net", "type": "ipvlan"}`, ""),
+		)
+
+		DescribeTable("should enforce the host interfaces of the namespace",
+			func(namespace, config, message string) {
+				response := validate(namespace, config)
+				if message == "" {
+					Expect(response.Allowed).To(BeTrue())
+					return
+				}
+				Expect(response.Allowed).To(BeFalse())
+				Expect(response.Result.Message).To(ContainSubstring(message))
+				Expect(response.AuditAnnotations).To(HaveKeyWithValue(auditAnnotationRule, RuleForbiddenInterface))
+			},
+			Entry("forbidden master", "platform-namespace",
+				`{"cniVersion": "0.3.1", "name": "some-net", "type": "macvlan", "master": "eth0"}`,
+				`spec.config.master: Forbidden: host interface "eth0" is forbidden in namespace platform-namespace`),
+			Entry("forbidden bridge in a conflist", "platform-namespace",
+				`{"cniVersion": "0.3.1", "name": "some-net", "plugins": [{"type": "bridge", "bridge": "br-ex"}, {"type": "tuning"}]}`,
+				`spec.config.plugins[0].bridge: Forbidden: host interface "br-ex" is forbidden`),
+			Entry("other master out of the allowed scope", "platform-namespace",
+				`{"cniVersion": "0.3.1", "name": "some-net", "type": "macvlan", "master": "eth1"}`, ""),
+			Entry("master matching an allowed glob", "tenant-namespace",
+				`{"cniVersion": "0.3.1", "name": "some-net", "type": "ipvlan", "master": "ens2f1"}`, ""),
+			Entry("master not matching the allowed globs", "tenant-namespace",
+				`{"cniVersion": "0.3.1", "name": "some-net", "type": "vlan", "master": "ens2f0", "vlanId": 100}`,
+				`spec.config.master: Forbidden: host interface "ens2f0" is not allowed in namespace tenant-namespace, allowed: ens*f1, 0000:3b:*`),
+			Entry("PCI address matching an allowed glob", "tenant-namespace",
+				`{"cniVersion": "0.3.1", "name": "some-net", "type": "userspace", "pciBusID": "0000:3b:02.0"}`, ""),
+			Entry("master of a nested delegate", "tenant-namespace",
+				`{"cniVersion": "0.3.1", "name": "some-net", "type": "multus", "delegates": [{"type": "macvlan", "master": "eth1"}]}`,
+				`spec.config.delegates[0].master: Forbidden: host interface "eth1" is not allowed`),
+		)
+
+		DescribeTable("should reject invalid policies",
+			func(policy string) {
+				Expect(LoadPolicy(writePolicy(policy))).NotTo(Succeed())
+			},
+			Entry("rule neither allowing nor denying", "pluginTypes:\n- namespaces: [some-namespace]\n"),
+			Entry("invalid namespace selector", "pluginTypes:\n- denied: [sriov]\n  namespaceSelector:\n    matchExpressions:\n    - {key: tier, operator: Bogus}\n"),
+			Entry("unknown structure", "pluginTypes: sriov\n"),
+			Entry("interface rule neither allowing nor forbidding", "interfaces:\n- namespaces: [some-namespace]\n"),
+			Entry("invalid glob", "interfaces:\n- forbidden: [\"eth[\"]\n"),
+			Entry("VLAN rule without ranges", "vlans:\n- namespaces: [some-namespace]\n"),
+			Entry("VLAN range out of bounds", "vlans:\n- ranges: [\"4000-4095\"]\n"),
+			Entry("reversed VLAN range", "vlans:\n- ranges: [\"200-100\"]\n"),
+		)
+	})
+
+	Describe("VLANs", func() {
+		var stopCh chan struct{}
+
+		newNad := func(namespace, config string) *netv1.NetworkAttachmentDefinition {
+			return &netv1.NetworkAttachmentDefinition{
+				ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "some-name"},
+				Spec:       netv1.NetworkAttachmentDefinitionSpec{Config: config},
+			}
+		}
+		validate := func(namespace, config string) *v1beta1.AdmissionResponse {
+			request := newRequest("NetworkAttachmentDefinition", v1beta1.Create, newNad(namespace, config), nil)
+			request.Namespace = namespace
+			return postReview("/validate", request).Response
+		}
+
+		BeforeEach(func() {
+			// the fake clientset does not list the net-attach-defs it is created with
+			nadClientset = nadfake.NewSimpleClientset()
+			for _, nad := range []*netv1.NetworkAttachmentDefinition{
+				newNad("other-namespace", `{"cniVersion": "0.3.1", "name": "some-net", "type": "vlan", "master": "ens1f0", "vlanId": 100}`),
+				newNad("trunk-namespace", `{"cniVersion": "0.3.1", "name": "some-net", "type": "bridge", "bridge": "br1", "vlanTrunk": [{"id": 5}, {"minID": 200, "maxID": 299}]}`),
+			} {
+				_, err := nadClientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions(nad.Namespace).Create(context.TODO(), nad, metav1.CreateOptions{})
+				Expect(err).NotTo(HaveOccurred())
+			}
+			stopCh = make(chan struct{})
+			Expect(watchNetworkAttachmentDefinitions(stopCh)).To(Succeed())
+			clusterPolicy = &Policy{VLANs: []VLANRule{{PolicyScope: PolicyScope{Namespaces: []string{"tenant-namespace"}}, Ranges: []string{"1000-1999", "5"}}}}
+			Expect(clusterPolicy.compile()).To(Succeed())
+		})
+
+		AfterEach(func() {
+			close(stopCh)
+			nadClientset = nil
+			nadCache = nil
+			clusterPolicy = nil
+		})
+
+		DescribeTable("should govern the VLANs of net-attach-defs",
+			func(namespace, config, rule, message string) {
+				response := validate(namespace, config)
+				if rule == "" {
+					Expect(response.Allowed).To(BeTrue())
+					return
+				}
+				Expect(response.Allowed).To(BeFalse())
+				Expect(response.Result.Message).To(ContainSubstring(message))
+				Expect(response.AuditAnnotations).To(HaveKeyWithValue(auditAnnotationRule, rule))
+			},
+			Entry("free VLAN", "some-namespace",
+				`{"cniVersion": "0.3.1", "name": "some-net", "type": "vlan", "master": "ens1f0", "vlanId": 101}`, "", ""),
+			Entry("VLAN out of range", "some-namespace",
+				`{"cniVersion": "0.3.1", "name": "some-net", "type": "vlan", "master": "ens1f0", "vlanId": 4095}`,
+				RuleInvalidVLAN, "spec.config.vlanId: Invalid value: 4095: must be a VLAN ID between 0 and 4094"),
+			Entry("VLAN which is not an integer", "some-namespace",
+				`{"cniVersion": "0.3.1", "name": "some-net", "type": "sriov", "vlan": "100"}`,
+				RuleInvalidVLAN, "spec.config.vlan: Invalid value: \"100\": must be an integer VLAN ID"),
+			Entry("invalid trunk range", "some-namespace",
+				`{"cniVersion": "0.3.1", "name": "some-net", "type": "bridge", "vlanTrunk": [{"minID": 20, "maxID": 10}]}`,
+				RuleInvalidVLAN, "spec.config.vlanTrunk[0].minID: Invalid value: 20: must not be greater than maxID"),
+			Entry("VLAN claimed on the master by another namespace", "some-namespace",
+				`{"cniVersion": "0.3.1", "name": "some-net", "type": "vlan", "master": "ens1f0", "vlanId": 100}`,
+				RuleVLANConflict, "spec.config.vlanId: Forbidden: VLAN 100 on ens1f0 is already claimed by other-namespace/some-name"),
+			Entry("VLAN claimed on another master", "some-namespace",
+				`{"cniVersion": "0.3.1", "name": "some-net", "type": "vlan", "master": "ens1f1", "vlanId": 100}`, "", ""),
+			Entry("VLAN claimed in the same namespace", "other-namespace",
+				`{"cniVersion": "0.3.1", "name": "some-net", "type": "vlan", "master": "ens1f0", "vlanId": 100}`, "", ""),
+			Entry("macvlan over a claimed VLAN", "some-namespace",
+				`{"cniVersion": "0.3.1", "name": "some-net", "type": "macvlan", "master": "ens1f0.100"}`,
+				RuleVLANConflict, "spec.config.master: Forbidden: VLAN 100 on ens1f0 is already claimed"),
+			Entry("bridge VLAN claimed by a trunk range", "some-namespace",
+				`{"cniVersion": "0.3.1", "name": "some-net", "plugins": [{"type": "bridge", "bridge": "br1", "vlan": 250}]}`,
+				RuleVLANConflict, "spec.config.plugins[0].vlan: Forbidden: VLAN 250 on br1 is already claimed by trunk-namespace/some-name"),
+			Entry("VLAN in the ranges of the namespace", "tenant-namespace",
+				`{"cniVersion": "0.3.1", "name": "some-net", "type": "vlan", "master": "ens1f0", "vlanId": 1500}`, "", ""),
+			Entry("VLAN out of the ranges of the namespace", "tenant-namespace",
+				`{"cniVersion": "0.3.1", "name": "some-net", "type": "vlan", "master": "ens1f0", "vlanId": 2000}`,
+				RuleForbiddenVLAN, "spec.config.vlanId: Forbidden: VLAN 2000 is not allowed in namespace tenant-namespace, allowed: 1000-1999, 5"),
+			Entry("untagged VLAN", "tenant-namespace",
+				`{"cniVersion": "0.3.1", "name": "some-net", "type": "bridge", "vlan": 0}`, "", ""),
+		)
+
+		It("should release the VLANs of deleted net-attach-defs", func() {
+			config := `{"cniVersion": "0.3.1", "name": "some-net", "type": "vlan", "master": "ens1f0", "vlanId": 100}`
+			Expect(validate("some-namespace", config).Allowed).To(BeFalse())
+			Expect(nadClientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions("other-namespace").Delete(
+				context.TODO(), "some-name", metav1.DeleteOptions{})).To(Succeed())
+			Eventually(func() bool {
+				return validate("some-namespace", config).Allowed
+			}).Should(BeTrue())
+		})
+	})
+
+	Describe("Cluster networks", func() {
+		validate := func(operation v1beta1.Operation, config, oldConfig string) *v1beta1.AdmissionResponse {
+			nad := &netv1.NetworkAttachmentDefinition{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "some-namespace", Name: "some-name"},
+				Spec:       netv1.NetworkAttachmentDefinitionSpec{Config: config},
+			}
+			var old *netv1.NetworkAttachmentDefinition
+			if oldConfig != "" {
+				old = nad.DeepCopy()
+				old.Spec.Config = oldConfig
+			}
+			request := newRequest("NetworkAttachmentDefinition", operation, nad, old)
+			request.Namespace = "some-namespace"
+			return postReview("/validate", request).Response
+		}
+
+		AfterEach(func() {
+			clusterNetworks = nil
+			clientset = nil
+		})
+
+		It("should reject invalid cluster networks", func() {
+			Expect(SetClusterNetworks([]string{"10.128.0.0/14"}, nil, "ignore")).To(MatchError(ContainSubstring("invalid action")))
+			Expect(SetClusterNetworks([]string{"10.128.0.0"}, nil, OverlapDeny)).To(MatchError(ContainSubstring("invalid pod network")))
+			Expect(StartNodeInformer(nil)).To(MatchError("cluster networks are not set"))
+		})
+
+		DescribeTable("should deny net-attach-defs overlapping the cluster networks",
+			func(config, message string) {
+				Expect(SetClusterNetworks([]string{"10.128.0.0/14"}, []string{"172.30.0.0/16", "fd02::/112"}, OverlapDeny)).To(Succeed())
+				response := validate(v1beta1.Create, config, "")
+				if message == "" {
+					Expect(response.Allowed).To(BeTrue())
+					return
+				}
+				Expect(response.Allowed).To(BeFalse())
+				Expect(response.Result.Message).To(ContainSubstring(message))
+				Expect(response.AuditAnnotations).To(HaveKeyWithValue(auditAnnotationRule, RuleClusterNetworkOverlap))
+			},
+			Entry("distinct subnet",
+				`{"cniVersion": "0.3.1", "name": "some-net", "type": "macvlan", "ipam": {"type": "host-local", "subnet": "192.168.1.0/24", "routes": [{"dst": "0.0.0.0/0"}]}}`, ""),
+			Entry("subnet in the pod network",
+				`{"cniVersion": "0.3.1", "name": "some-net", "type": "macvlan", "ipam": {"type": "host-local", "subnet": "10.129.0.0/24"}}`,
+				"spec.config.ipam.subnet: Forbidden: 10.129.0.0/24 overlaps the pod network 10.128.0.0/14"),
+			Entry("whereabouts range containing the service network",
+				`{"cniVersion": "0.3.1", "name": "some-net", "type": "macvlan", "ipam": {"type": "whereabouts", "range": "172.16.0.10-172.16.0.0/12"}}`,
+				"spec.config.ipam.range: Forbidden: 172.16.0.0/12 overlaps the service network 172.30.0.0/16"),
+			Entry("range set in the IPv6 service network",
+				`{"cniVersion": "0.3.1", "name": "some-net", "type": "macvlan", "ipam": {"type": "host-local", "ranges": [[{"subnet": "fd01::/64"}], [{"subnet": "fd02::/120"}]]}}`,
+				"spec.config.ipam.ranges[1][0].subnet: Forbidden: fd02::/120 overlaps the service network fd02::/112"),
+			Entry("route to the service network in a delegate",
+				`{"cniVersion": "0.3.1", "name": "some-net", "type": "multus", "delegates": [{"type": "macvlan", "ipam": {"type": "static", "routes": [{"dst": "172.30.1.0/24"}]}}]}`,
+				"spec.config.delegates[0].ipam.routes[0].dst: Forbidden: 172.30.1.0/24 overlaps the service network 172.30.0.0/16"),
+		)
+
+		It("should warn about net-attach-defs overlapping the cluster networks", func() {
+			Expect(SetClusterNetworks([]string{"10.128.0.0/14"}, nil, OverlapWarn)).To(Succeed())
+			config := `{"cniVersion": "0.3.1", "name": "some-net", "type": "macvlan", "ipam": {"type": "host-local", "subnet": "10.129.0.0/24"}}`
+			response := validate(v1beta1.Create, config, "")
+			Expect(response.Allowed).To(BeTrue())
+			Expect(response.Warnings).To(ConsistOf("spec.config.ipam.subnet: 10.129.0.0/24 overlaps the pod network 10.128.0.0/14"))
+
+			By("not warning again on updates keeping the config")
+			Expect(validate(v1beta1.Update, config, config).Warnings).To(BeEmpty())
+
+			By("reporting the overlaps as warnings in evaluations")
+			raw, err := json.Marshal(netv1.NetworkAttachmentDefinition{
+				TypeMeta:   metav1.TypeMeta{APIVersion: "k8s.cni.cncf.io/v1", Kind: "NetworkAttachmentDefinition"},
+				ObjectMeta: metav1.ObjectMeta{Name: "some-net"},
+				Spec:       netv1.NetworkAttachmentDefinitionSpec{Config: config},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			report, err := evaluate(raw, "some-namespace")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report.Allowed).To(BeTrue())
+			Expect(report.Results).To(ContainElement(RuleResult{Rule: RuleClusterNetworkOverlap, Result: resultWarn, Field: "spec.config.ipam.subnet",
+				Message: "spec.config.ipam.subnet: Forbidden: 10.129.0.0/24 overlaps the pod network 10.128.0.0/14"}))
+		})
+
+		It("should discover the networks of the nodes", func() {
+			clientset = fake.NewSimpleClientset(&v1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: "some-node"},
+				Spec:       v1.NodeSpec{PodCIDRs: []string{"10.244.1.0/24"}},
+				Status: v1.NodeStatus{Addresses: []v1.NodeAddress{
+					{Type: v1.NodeExternalIP, Address: "203.0.113.10"},
+					{Type: v1.NodeInternalIP, Address: "192.168.10.5"},
+				}},
+			})
+			Expect(SetClusterNetworks(nil, nil, OverlapDeny)).To(Succeed())
+			stopCh := make(chan struct{})
+			defer close(stopCh)
+			Expect(StartNodeInformer(stopCh)).To(Succeed())
+
+			response := validate(v1beta1.Create, `{"cniVersion": "0.3.1", "name": "some-net", "type": "macvlan", "ipam": {"type": "host-local", "subnet": "10.244.1.128/25"}}`, "")
+			Expect(response.Allowed).To(BeFalse())
+			Expect(response.Result.Message).To(ContainSubstring("10.244.1.128/25 overlaps the pod network of node some-node 10.244.1.0/24"))
+			response = validate(v1beta1.Create, `{"cniVersion": "0.3.1", "name": "some-net", "type": "macvlan", "ipam": {"type": "host-local", "subnet": "192.168.10.0/24"}}`, "")
+			Expect(response.Allowed).To(BeFalse())
+			Expect(response.Result.Message).To(ContainSubstring("192.168.10.0/24 overlaps the address of node some-node 192.168.10.5/32"))
+			Expect(validate(v1beta1.Create, `{"cniVersion": "0.3.1", "name": "some-net", "type": "macvlan", "ipam": {"type": "host-local", "subnet": "203.0.113.0/24"}}`, "").Allowed).To(BeTrue())
+
+			By("only checking the node addresses against the allocated range")
+			Expect(validate(v1beta1.Create, `{"cniVersion": "0.3.1", "name": "some-net", "type": "macvlan", "ipam": {"type": "host-local",
+				"subnet": "192.168.10.0/24", "rangeStart": "192.168.10.100", "rangeEnd": "192.168.10.200"}}`, "").Allowed).To(BeTrue())
+			Expect(validate(v1beta1.Create, `{"cniVersion": "0.3.1", "name": "some-net", "type": "macvlan", "ipam": {"type": "host-local",
+				"ranges": [[{"subnet": "192.168.10.0/24", "rangeStart": "192.168.10.100"}]]}}`, "").Allowed).To(BeTrue())
+			Expect(validate(v1beta1.Create, `{"cniVersion": "0.3.1", "name": "some-net", "type": "macvlan", "ipam": {"type": "whereabouts",
+				"range": "192.168.10.0/24", "range_start": "192.168.10.100", "range_end": "192.168.10.200"}}`, "").Allowed).To(BeTrue())
+			response = validate(v1beta1.Create, `{"cniVersion": "0.3.1", "name": "some-net", "type": "macvlan", "ipam": {"type": "host-local",
+				"subnet": "192.168.10.0/24", "rangeStart": "192.168.10.2", "rangeEnd": "192.168.10.200"}}`, "")
+			Expect(response.Allowed).To(BeFalse())
+			Expect(response.Result.Message).To(ContainSubstring("192.168.10.0/24 overlaps the address of node some-node 192.168.10.5/32"))
+			Expect(validate(v1beta1.Create, `{"cniVersion": "0.3.1", "name": "some-net", "type": "macvlan", "ipam": {"type": "host-local",
+				"subnet": "10.244.1.0/24", "rangeStart": "10.244.1.100"}}`, "").Allowed).To(BeFalse())
+		})
+
+		It("should not share the node networks between concurrent requests", func() {
+			nodes := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+			for i := 0; i < 8; i++ {
+				Expect(nodes.Add(&v1.Node{
+					ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("node-%d", i)},
+					Status: v1.NodeStatus{Addresses: []v1.NodeAddress{
+						{Type: v1.NodeInternalIP, Address: fmt.Sprintf("192.168.10.%d", i+1)},
+					}},
+				})).To(Succeed())
+			}
+			Expect(SetClusterNetworks([]string{"10.128.0.0/14", "10.0.0.0/16"}, []string{"172.30.0.0/16"}, OverlapDeny)).To(Succeed())
+			// leave spare capacity to the configured networks
+			static := make([]clusterNetwork, len(clusterNetworks.static), len(clusterNetworks.static)+1)
+			copy(static, clusterNetworks.static)
+			clusterNetworks.static = static
+			clusterNetworks.nodeLister = corelisters.NewNodeLister(nodes)
+
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer GinkgoRecover()
+					defer wg.Done()
+					plugins := []pluginConfig{{path: field.NewPath("spec", "config"), conf: map[string]interface{}{
+						"type": "macvlan",
+						"ipam": map[string]interface{}{"type": "static", "routes": []interface{}{
+							map[string]interface{}{"dst": fmt.Sprintf("192.168.10.%d/32", i+1)}}},
+					}}}
+					errs := clusterNetworkOverlaps(plugins)
+					Expect(errs).To(HaveLen(1))
+					Expect(errs[0].Detail).To(ContainSubstring(fmt.Sprintf("overlaps the address of node node-%d", i)))
+				}(i)
+			}
+			wg.Wait()
+			Expect(static[:cap(static)][len(static)]).To(Equal(clusterNetwork{}))
+		})
+	})
+
+	Describe("Quotas", func() {
+		var stopCh chan struct{}
+
+		newNad := func(namespace, name string) *netv1.NetworkAttachmentDefinition {
+			return &netv1.NetworkAttachmentDefinition{
+				ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+				Spec:       netv1.NetworkAttachmentDefinitionSpec{Config: `{"cniVersion": "0.3.1", "name": "some-net", "type": "macvlan"}`},
+			}
+		}
+		review := func(path, kind string, operation v1beta1.Operation, namespace string, object, oldObject interface{}) *v1beta1.AdmissionResponse {
+			request := newRequest(kind, operation, object, oldObject)
+			request.Namespace = namespace
+			return postReview(path, request).Response
+		}
+		podAttaching := func(namespace, networks string) v1.Pod {
+			return v1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Namespace:   namespace,
+				Name:        "some-name",
+				Annotations: map[string]string{networksAnnotationKey: networks},
+			}}
+		}
+
+		BeforeEach(func() {
+			clientset = fake.NewSimpleClientset(
+				&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "big-namespace", Annotations: map[string]string{
+					maxNetAttachDefsKey:       "3",
+					maxAttachmentsPerPodKey:   "0",
+					maxPodsPerNetAttachDefKey: "10",
+				}}},
+				&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "invalid-namespace", Labels: map[string]string{
+					maxNetAttachDefsKey: "many",
+				}}},
+			)
+			nadClientset = nadfake.NewSimpleClientset()
+			for _, nad := range []*netv1.NetworkAttachmentDefinition{
+				newNad("some-namespace", "net-1"),
+				newNad("some-namespace", "net-2"),
+				newNad("big-namespace", "net-1"),
+				newNad("big-namespace", "net-2"),
+				newNad("invalid-namespace", "net-1"),
+				newNad("invalid-namespace", "net-2"),
+			} {
+				_, err := nadClientset.K8sCniCncfIoV1().NetworkAttachmentDefinitions(nad.Namespace).Create(context.TODO(), nad, metav1.CreateOptions{})
+				Expect(err).NotTo(HaveOccurred())
+			}
+			stopCh = make(chan struct{})
+			Expect(watchNetworkAttachmentDefinitions(stopCh)).To(Succeed())
+			Expect(SetQuotas(Quotas{NetAttachDefsPerNamespace: 2, AttachmentsPerPod: 2, PodsPerNetAttachDef: 1})).To(Succeed())
+			SetPodCounter(func(key string) int {
+				return map[string]int{"some-namespace/net-1": 1, "big-namespace/net-1": 5}[key]
+			})
+		})
+
+		AfterEach(func() {
+			close(stopCh)
+			clientset = nil
+			nadClientset = nil
+			nadCache = nil
+			quotas = Quotas{}
+			SetPodCounter(nil)
+		})
+
+		It("should reject negative quotas", func() {
+			Expect(SetQuotas(Quotas{AttachmentsPerPod: -1})).To(MatchError("quotas must not be negative"))
+		})
+
+		DescribeTable("should limit the net-attach-defs per namespace",
+			func(namespace string, allowed bool) {
+				response := review("/validate", "NetworkAttachmentDefinition", v1beta1.Create, namespace, newNad(namespace, "net-3"), nil)
+				Expect(response.Allowed).To(Equal(allowed))
+				if !allowed {
+					Expect(response.Result.Message).To(ContainSubstring(
+						"metadata.namespace: Forbidden: namespace %s already has 2 net-attach-defs, the maximum is 2", namespace))
+					Expect(response.AuditAnnotations).To(HaveKeyWithValue(auditAnnotationRule, RuleNetAttachDefQuota))
+				}
+			},
+			Entry("namespace at the quota", "some-namespace", false),
+			Entry("namespace raising the quota", "big-namespace", true),
+			Entry("namespace with an invalid quota", "invalid-namespace", false),
+			Entry("empty namespace", "other-namespace", true),
+		)
+
+		It("should let net-attach-defs over the quota be updated", func() {
+			nad := newNad("some-namespace", "net-2")
+			oldNad := nad.DeepCopy()
+			nad.Spec.Config = `{"cniVersion": "0.3.1", "name": "other-net", "type": "macvlan"}`
+			Expect(review("/validate", "NetworkAttachmentDefinition", v1beta1.Update, "some-namespace", nad, oldNad).Allowed).To(BeTrue())
+		})
+
+		DescribeTable("should limit the attachments of pods",
+			func(namespace, networks, rule, message string) {
+				response := review("/isolate", "Pod", v1beta1.Create, namespace, podAttaching(namespace, networks), nil)
+				if rule == "" {
+					Expect(response.Allowed).To(BeTrue())
+					return
+				}
+				Expect(response.Allowed).To(BeFalse())
+				Expect(response.Result.Message).To(ContainSubstring(message))
+				Expect(response.AuditAnnotations).To(HaveKeyWithValue(auditAnnotationRule, rule))
+			},
+			Entry("pod within the quotas", "some-namespace", "net-2,net-2", "", ""),
+			Entry("pod attaching too many networks", "some-namespace", "net-2,net-2,net-2",
+				RuleAttachmentQuota, "pod attaches to 3 networks, the maximum is 2"),
+			Entry("pod of a namespace without attachment limit", "big-namespace", "net-2,net-2,net-2", "", ""),
+			Entry("pod attaching a net-attach-def at the quota", "some-namespace", "net-2,net-1",
+				RulePodQuota, "[1]: Forbidden: net-attach-def some-namespace/net-1 is already attached to 1 pods, the maximum is 1"),
+			Entry("pod attaching a net-attach-def of a namespace raising the quota", "big-namespace", "net-1", "", ""),
+		)
+
+		It("should only count new pods", func() {
+			pod := podAttaching("some-namespace", "net-1")
+			oldPod := pod.DeepCopy()
+			pod.Labels = map[string]string{"some": "label"}
+			Expect(review("/isolate", "Pod", v1beta1.Update, "some-namespace", pod, oldPod).Allowed).To(BeTrue())
+
+			By("not limiting the pods before they can be counted")
+			SetPodCounter(nil)
+			Expect(review("/isolate", "Pod", v1beta1.Create, "some-namespace", pod, nil).Allowed).To(BeTrue())
+		})
+
+		It("should report the quotas in evaluations", func() {
+			nad := newNad("", "net-3")
+			nad.Kind = "NetworkAttachmentDefinition"
+			raw, err := json.Marshal(nad)
+			Expect(err).NotTo(HaveOccurred())
+			report, err := evaluate(raw, "some-namespace")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report.Allowed).To(BeFalse())
+			Expect(report.Results).To(ContainElement(RuleResult{Rule: RuleNetAttachDefQuota, Result: resultFail, Field: "metadata.namespace",
+				Message: "metadata.namespace: Forbidden: namespace some-namespace already has 2 net-attach-defs, the maximum is 2"}))
+
+			pod := podAttaching("", "net-2,net-1,net-2")
+			pod.Kind = "Pod"
+			raw, err = json.Marshal(pod)
+			Expect(err).NotTo(HaveOccurred())
+			report, err = evaluate(raw, "some-namespace")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report.Allowed).To(BeFalse())
+			Expect(report.Results).To(ContainElement(RuleResult{Rule: RuleAttachmentQuota, Result: resultFail, Field: networksAnnotationPath.String(),
+				Message: networksAnnotationPath.String() + ": Forbidden: pod attaches to 3 networks, the maximum is 2"}))
+			Expect(report.Results).To(ContainElement(RuleResult{Rule: RulePodQuota, Result: resultFail, Field: networksAnnotationPath.Index(1).String(),
+				Message: networksAnnotationPath.Index(1).String() + ": Forbidden: net-attach-def some-namespace/net-1 is already attached to 1 pods, the maximum is 1"}))
+		})
+	})
 })